@@ -0,0 +1,95 @@
+package goagain
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// A process in the restart chain, identified by pid and, where it could be
+// determined, start time so a recycled pid isn't mistaken for it.
+type ancestor struct {
+	pid   int
+	start uint64
+}
+
+func (a ancestor) String() string {
+	return fmt.Sprintf("%d/%d", a.pid, a.start)
+}
+
+// Test whether a is still the process it was when recorded.  Without a
+// start time to check, a pid may have been recycled for some unrelated
+// process, so it doesn't count as alive; off Linux that's every ancestor.
+func (a ancestor) alive() bool {
+	if 0 == a.start {
+		return false
+	}
+	if err := killRetryEINTR(a.pid, 0); nil != err && syscall.EPERM != err {
+		return false
+	}
+	start, err := procStartTime(a.pid)
+	return nil == err && start == a.start
+}
+
+var (
+	ancestorsOnce sync.Once
+	ancestors     []ancestor
+)
+
+// Our ancestors, oldest first and ending with our parent, read from
+// GOAGAIN_ANCESTORS before the first fork overwrites it.
+func ownAncestors() []ancestor {
+	ancestorsOnce.Do(func() {
+		for _, s := range strings.Fields(os.Getenv("GOAGAIN_ANCESTORS")) {
+			var a ancestor
+			if _, err := fmt.Sscanf(s, "%d/%d", &a.pid, &a.start); nil != err {
+				logln("ignoring bad GOAGAIN_ANCESTORS entry", s)
+				continue
+			}
+			ancestors = append(ancestors, a)
+		}
+	})
+	return ancestors
+}
+
+// Record the child's ancestors: those of ours still alive followed by us.
+func setAncestors() error {
+	var chain []ancestor
+	for _, a := range ownAncestors() {
+		if a.alive() {
+			chain = append(chain, a)
+		}
+	}
+	self := ancestor{pid: syscall.Getpid()}
+	self.start, _ = procStartTime(self.pid)
+	chain = append(chain, self)
+	s := make([]string, len(chain))
+	for i, a := range chain {
+		s[i] = a.String()
+	}
+	return setenv("GOAGAIN_ANCESTORS", strings.Join(s, " "))
+}
+
+// Send sig to every ancestor beyond our immediate parent that's still alive,
+// cleaning up after earlier restarts whose parent missed its quit signal.
+// Pids that have exited or been recycled for another process are skipped.
+// Telling them apart needs process start times, which goagain only reads on
+// Linux, so elsewhere this signals nothing.
+func ReapAncestors(sig syscall.Signal) error {
+	chain := ownAncestors()
+	if len(chain) < 2 {
+		return nil
+	}
+	for _, a := range chain[:len(chain)-1] {
+		if !a.alive() {
+			continue
+		}
+		logln("sending signal", sig, "to lingering ancestor", a.pid)
+		if err := killRetryEINTR(a.pid, sig); nil != err && syscall.ESRCH != err {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package goagain
+
+import (
+	"os"
+	"testing"
+)
+
+func TestAncestorAlive(t *testing.T) {
+	self := ancestor{pid: os.Getpid()}
+	start, err := procStartTime(self.pid)
+	if nil != err {
+		t.Skip("no process start times here:", err)
+	}
+	for _, tt := range []struct {
+		name string
+		a    ancestor
+		want bool
+	}{
+		{"same process", ancestor{self.pid, start}, true},
+		{"unknown start", self, false},
+		{"recycled pid", ancestor{self.pid, start + 1}, false},
+		{"exited", ancestor{1 << 30, start}, false},
+	} {
+		if got := tt.a.alive(); tt.want != got {
+			t.Errorf("%s: alive %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
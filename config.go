@@ -0,0 +1,226 @@
+package goagain
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Everything that governs a restart, in place of an ever-growing parameter
+// list.  The zero value is usable.
+type Config struct {
+
+	// The signal that triggers a restart.  Defaults to SIGHUP.
+	ForkSignal syscall.Signal
+
+	// The signal the child sends, via Kill, once it has taken over.
+	// Defaults to SIGQUIT.
+	QuitSignal syscall.Signal
+
+	// How long to wait for the quit signal before killing the child.  Zero
+	// waits indefinitely.  That's a change: Wait used to give up straight
+	// away on a zero timeout, killing every child as soon as it was forked,
+	// so a caller relying on that to disable restarts must now not call
+	// Wait at all.
+	Timeout time.Duration
+
+	// How long a child that's still running may take to send the quit
+	// signal, for one with an expensive warmup, say loading a large dataset,
+	// before it's considered stuck.  A child that exits is given up on right
+	// away however long this is.  When it's no longer than Timeout, Timeout
+	// alone applies, as it does when Timeout is zero.
+	WarmupTimeout time.Duration
+
+	// A wall-clock budget for the whole restart, from the fork signal to the
+	// child taking over, however the time is split between phases.  When it
+	// runs out the child is killed and Wait returns an error satisfying
+	// errors.Is(err, context.DeadlineExceeded) while the parent keeps
+	// serving.  Zero means no budget beyond Timeout.
+	Deadline time.Duration
+
+	// Consulted on each fork signal; returning false defers the restart,
+	// for instance while a batch job is running.  A deferred restart stays
+	// pending and goes ahead once CanRestart returns true, without needing
+	// another fork signal.
+	CanRestart func() bool
+
+	// Refuse a restart in a process that's been up for less than this, on
+	// the assumption that a generation restarted that quickly came from a
+	// broken deploy caught in a loop.  Wait returns ErrRestartTooSoon and
+	// the caller keeps serving.  Since each generation must reach it, a
+	// MinUptime of 6s caps restarts at ten a minute; Env's Generation lets
+	// CanRestart apply a policy of its own on top.  Zero disables the check.
+	MinUptime time.Duration
+
+	// How often a deferred restart re-checks CanRestart.  Defaults to a
+	// second.
+	DeferInterval time.Duration
+
+	// Called at the start and end of each Phase of a restart, with enough
+	// context for an adapter to open and close a tracing span.
+	OnPhase func(PhaseEvent)
+
+	// Called with the child's pid as soon as it's been spawned.
+	OnFork func(pid int)
+
+	// Run once after the child sends the quit signal and before Wait
+	// returns, as a final promotion gate, say one more request to its health
+	// endpoint.  An error kills the child and Wait returns ErrVerifyFailed
+	// so the parent keeps serving.
+	Verify func() error
+
+	// Run after Verify to check the child speaks the protocol clients and
+	// load balancers expect, as opposed to being merely alive, say by a
+	// HEAD request checking a version header.  childAddr is the address
+	// the child reported with ReportAddr or Rebind or, if it reported
+	// none, the listener it shares with us, where the probe may be
+	// answered by either generation; a child with a private admin port
+	// should report that.  An error kills the child and Wait returns
+	// ErrIncompatible so the parent keeps serving.
+	CompatCheck func(childAddr string) error
+
+	// Polled after the checks above, while we keep serving, until it
+	// reports that traffic has actually reached the child, say by asking
+	// the load balancer whether the child's target is healthy.  Only then
+	// does the handoff go ahead.  It's polled every ExternalReadyInterval,
+	// a second by default.  An error counts as not ready yet.  If it
+	// hasn't reported ready within ExternalReadyTimeout, a minute by
+	// default, the child is killed and Wait returns
+	// ErrNotExternallyReady.
+	ExternalReady         func() (bool, error)
+	ExternalReadyInterval time.Duration
+	ExternalReadyTimeout  time.Duration
+
+	// Called with the child's pid once it has sent the quit signal and
+	// passed Verify, before any standby.
+	OnHandoff func(pid int)
+
+	// How many more times to fork a fresh child when one aborts the restart
+	// with SignalAbort, say because FileListener hit a transient ENFILE, or
+	// exits before it's ready, before giving up.  The parent keeps serving
+	// throughout.  Zero gives up on the first abort.
+	ForkRetries int
+
+	// How long to wait before the first retry, doubling for each one after.
+	// Defaults to a second.
+	RetryBackoff time.Duration
+
+	// A hard bound on how long the parent may take to exit once a restart
+	// succeeds.  When it runs out, because draining or cleanup hung, the
+	// process exits with status 1 regardless so the old generation can't
+	// linger.  That's a bug in the shutdown path and is logged as one.
+	// Zero disables the watchdog.
+	ExitWatchdog time.Duration
+
+	// Run in the old generation once a restart succeeds, before Wait
+	// returns, for last flushes such as pushing metrics.  It runs in its
+	// own goroutine so ParentExitTimeout can bound it; one that overruns is
+	// abandoned, still running, and Wait returns regardless.  Keep it fast
+	// and idempotent, since it may be cut short and the process may exit
+	// while it's still going.
+	OnParentExit func()
+
+	// How long OnParentExit may take.  Zero waits for it indefinitely, or
+	// until ExitWatchdog, which is armed first, fires.
+	ParentExitTimeout time.Duration
+
+	// A disruption budget for the drain that follows a handoff, in the
+	// Groups and goagainhttp servers that drain for themselves: if more
+	// than this many connections are still open at the drain timeout, the
+	// restart's outcome is OutcomeTooDisruptive and its error
+	// ErrTooDisruptive, though the child is up and serving.  They're still
+	// force-closed; the failure is for deploy tooling to alert on or roll
+	// back.  Zero means no budget.
+	MaxForceClose int
+
+	// Experimental: have the child report that it's ready, or that it's
+	// aborting, by an atomic write to a small shared memory region the
+	// parent polls rather than by signal, so nothing hinges on a signal
+	// being delivered to the right handler.  The child's Kill and
+	// SignalAbort use the region automatically.  Signals remain the default
+	// and are still used for everything else.
+	SharedMemory bool
+
+	// Queue a fork signal that arrives while a restart is under way rather
+	// than ignoring it, for rapid successive deploys where the second one
+	// has an even newer binary.  Any number of them make one more restart.
+	// If the current restart fails, Wait runs the queued one straight
+	// away.  If it succeeds, the queued restart belongs to the child: the
+	// parent forwards the fork signal to it, and the child restarts as soon
+	// as it calls Wait, MinUptime and CanRestart permitting.  The child
+	// catches the signal from startup, as with Init, so the child's binary
+	// must be built with a goagain that supports this.
+	QueueRestarts bool
+
+	// The buffer size of each channel goagain hands to signal.Notify.
+	// Defaults to 1.  Every signal gets its own channel so a burst of fork
+	// signals can't crowd out a quit or abort signal, but signals of the
+	// same kind that arrive faster than they're handled are coalesced: the
+	// kernel already merges pending standard signals and os/signal drops
+	// whatever doesn't fit in the buffer.  A bigger buffer only keeps more
+	// fork signals queued; restarts still run one at a time and extra ones
+	// are ignored while a restart is in progress.
+	SignalBuffer int
+
+	ForkOptions
+}
+
+// A reusable restart handler built from a Config.
+type Handler struct {
+	cfg        Config
+	restarting atomic.Bool
+	queued     atomic.Bool
+
+	resultMu sync.Mutex
+	result   RestartResult
+	history  []RestartResult
+	archived bool
+
+	sigMu       sync.Mutex
+	sigs        signalSet
+	sigsChanged chan struct{}
+}
+
+// Make a Handler, filling in defaults for any zero fields in cfg.
+func NewWithConfig(cfg Config) *Handler {
+	if 0 == cfg.ForkSignal {
+		cfg.ForkSignal = syscall.SIGHUP
+	}
+	if 0 == cfg.QuitSignal {
+		cfg.QuitSignal = syscall.SIGQUIT
+	}
+	if 0 == cfg.DeferInterval {
+		cfg.DeferInterval = time.Second
+	}
+	if 0 == cfg.RetryBackoff {
+		cfg.RetryBackoff = time.Second
+	}
+	if 0 >= cfg.ExternalReadyInterval {
+		cfg.ExternalReadyInterval = time.Second
+	}
+	if 0 >= cfg.ExternalReadyTimeout {
+		cfg.ExternalReadyTimeout = time.Minute
+	}
+	if 0 >= cfg.SignalBuffer {
+		cfg.SignalBuffer = 1
+	}
+	h := &Handler{
+		cfg: cfg,
+		sigs: signalSet{
+			fork:  cfg.ForkSignal,
+			quit:  cfg.QuitSignal,
+			ready: cfg.ReadySignal,
+			abort: cfg.AbortSignal,
+		},
+		sigsChanged: make(chan struct{}),
+	}
+	h.holdSignals()
+	return h
+}
+
+// Make a channel for signal.Notify sized by Config.SignalBuffer.
+func (h *Handler) signalCh() chan os.Signal {
+	return make(chan os.Signal, h.cfg.SignalBuffer)
+}
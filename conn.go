@@ -0,0 +1,222 @@
+package goagain
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// A file marked to be passed to the next child.
+type transfer struct {
+	f *os.File
+
+	// The variable recording f's fd for the child, if goagain set it, to
+	// unset once f is released.
+	env string
+}
+
+var (
+	transferMu  sync.Mutex
+	transferred []transfer
+)
+
+// Mark an already-accepted connection to be passed to the next child and
+// return the file descriptor it will have there.  EXPERIMENTAL.  c may be
+// a wrapper, such as a GracefulListener's, with an Unwrap() net.Conn method
+// leading to the *net.TCPConn or *net.UnixConn underneath.
+//
+// The fd is passed at the same number the child sees, so it must be handed to
+// the child by some other means (the environment works) and reconstructed
+// there with ConnFromFd.  Caveats: the kernel carries the TCP state over but
+// not anything buffered in userspace, so the caller must stop reading and
+// writing c before the fork and the child must resume the application
+// protocol exactly where the parent left off.  Bytes in flight are delivered
+// to whichever process reads first.  The parent should close c once the child
+// has taken over; goagain only releases its own duplicate.
+//
+// A mark lasts for one restart: every child it forks, ForkRetries included,
+// gets the fd at the same number, and the duplicate is released once the
+// restart ends, however it ends.  After a failed restart the fd means
+// nothing, so mark c again for the next one and stop advertising the old
+// number; TransferFileEnv does the latter for you.
+func TransferConn(c net.Conn) (uintptr, error) {
+	var (
+		f   *os.File
+		err error
+	)
+	switch t := unwrapConn(c).(type) {
+	case *net.TCPConn:
+		f, err = t.File()
+	case *net.UnixConn:
+		f, err = t.File()
+	default:
+		return 0, fmt.Errorf(
+			"connection is %T not *net.TCPConn or *net.UnixConn",
+			c,
+		)
+	}
+	if f, err = aboveStdio(f, err); nil != err {
+		return 0, err
+	}
+	return markTransfer(transfer{f: f}), nil
+}
+
+// Drill down through connections that wrap others, such as those accepted
+// from a GracefulListener, as unwrap does for listeners.
+func unwrapConn(c net.Conn) net.Conn {
+	for {
+		u, ok := c.(interface {
+			Unwrap() net.Conn
+		})
+		if !ok {
+			return c
+		}
+		next := u.Unwrap()
+		if nil == next || next == c {
+			return c
+		}
+		c = next
+	}
+}
+
+// Mark a raw file, typically one end of a socketpair(2) used for IPC between
+// components, to be passed to the next child and return the file descriptor
+// it will have there, as with TransferConn.  goagain passes a duplicate so f
+// stays the caller's.  Both ends of the pair need managing across the fork:
+// whichever process holds the other end sees EOF only once every copy of this
+// end, ours and the child's, is closed, and anything written before the
+// child takes over is read by whichever process reads first.  The mark lasts
+// for one restart, as with TransferConn.
+func TransferFile(f *os.File) (uintptr, error) {
+	dup, err := dupFile(f)
+	if nil != err {
+		return 0, err
+	}
+	return markTransfer(transfer{f: dup}), nil
+}
+
+// Mark f like TransferFile and record the fd it will have in the child in
+// the environment variable key, which is unset again when the duplicate is
+// released, so no later child finds a number that by then names some other
+// file.  Marking another file under the same key replaces the first, say to
+// pass fresh contents to each of a restart's ForkRetries.
+func TransferFileEnv(f *os.File, key string) error {
+	dup, err := dupFile(f)
+	if nil != err {
+		return err
+	}
+	transferMu.Lock()
+	for i, t := range transferred {
+		if key == t.env {
+			t.f.Close()
+			transferred = append(transferred[:i], transferred[i+1:]...)
+			break
+		}
+	}
+	transferMu.Unlock()
+	fd := markTransfer(transfer{f: dup, env: key})
+	if err := os.Setenv(key, fmt.Sprint(fd)); nil != err {
+		closeTransfer(dup)
+		return err
+	}
+	return nil
+}
+
+// A close-on-exec duplicate of f clear of stdio.
+func dupFile(f *os.File) (*os.File, error) {
+	var fd int
+	err := retryEINTR(func() (err error) {
+		fd, err = syscall.Dup(int(sysfd(f)))
+		return
+	})
+	if nil != err {
+		return nil, err
+	}
+	syscall.CloseOnExec(fd)
+	return aboveStdio(os.NewFile(uintptr(fd), f.Name()), nil)
+}
+
+// Add t to the files passed to the next child and return its fd.
+func markTransfer(t transfer) uintptr {
+	transferMu.Lock()
+	defer transferMu.Unlock()
+	transferred = append(transferred, t)
+	return sysfd(t.f)
+}
+
+// Reconstruct the connected Unix socket, one end of a socketpair, passed by
+// the parent via TransferFile.
+func SocketpairFromFd(fd uintptr) (*net.UnixConn, error) {
+	c, err := ConnFromFd(fd)
+	if nil != err {
+		return nil, err
+	}
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		c.Close()
+		return nil, fmt.Errorf("file descriptor is %T not *net.UnixConn", c)
+	}
+	return uc, nil
+}
+
+// Reconstruct a net.Conn passed by the parent via TransferConn.  EXPERIMENTAL.
+func ConnFromFd(fd uintptr) (c net.Conn, err error) {
+	// As in Listener, FileConn makes its own copy of the fd.
+	f := os.NewFile(fd, fmt.Sprintf("goagain-conn:%d", fd))
+	defer f.Close()
+	c, err = net.FileConn(f)
+	if nil != err {
+		return
+	}
+	switch c.(type) {
+	case *net.TCPConn, *net.UnixConn:
+	default:
+		c.Close()
+		c, err = nil, fmt.Errorf(
+			"file descriptor is %T not *net.TCPConn or *net.UnixConn",
+			c,
+		)
+	}
+	return
+}
+
+func transferredFiles() []*os.File {
+	transferMu.Lock()
+	defer transferMu.Unlock()
+	files := make([]*os.File, len(transferred))
+	for i, t := range transferred {
+		files[i] = t.f
+	}
+	return files
+}
+
+// Forget the transfer of f, closing it.
+func closeTransfer(f *os.File) {
+	transferMu.Lock()
+	defer transferMu.Unlock()
+	for i, t := range transferred {
+		if f == t.f {
+			transferred = append(transferred[:i], transferred[i+1:]...)
+			break
+		}
+	}
+	f.Close()
+}
+
+// Release our duplicates of transferred files, and stop advertising their
+// fds, once the restart they were marked for is over.
+func closeTransferred() {
+	transferMu.Lock()
+	defer transferMu.Unlock()
+	for _, t := range transferred {
+		t.f.Close()
+		if "" != t.env {
+			if err := os.Unsetenv(t.env); nil != err {
+				logln("Unable to unset", t.env, err)
+			}
+		}
+	}
+	transferred = nil
+}
@@ -0,0 +1,114 @@
+package goagain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// A transferred file reaches every attempt of a restart at the same fd and
+// is forgotten, environment and all, once the restart is over.
+func TestTransferLastsOneRestart(t *testing.T) {
+	keepEnv(t)
+	starts := standIn(t, "exit", 0)
+	r, w, err := os.Pipe()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	if err := TransferFileEnv(r, "GOAGAIN_TEST_FD"); nil != err {
+		t.Fatal(err)
+	}
+	var fd uintptr
+	fmt.Sscan(os.Getenv("GOAGAIN_TEST_FD"), &fd)
+
+	h := NewWithConfig(Config{
+		Timeout:      5 * time.Second,
+		ForkRetries:  1,
+		RetryBackoff: time.Millisecond,
+	})
+	th := handoff{ls: []net.Listener{listenTCP(t)}}
+	th.sigs, _ = h.signals()
+	if err := h.restart(context.Background(), th, nil); !errors.Is(err, ErrChildDied) {
+		t.Fatalf("restart: %v, want %v", err, ErrChildDied)
+	}
+
+	if 2 != len(*starts) {
+		t.Fatalf("%d forks, want 2", len(*starts))
+	}
+	for i, attr := range *starts {
+		if uintptr(len(attr.Files)) <= fd || nil == attr.Files[fd] {
+			t.Errorf("attempt %d: fd %d not passed", i+1, fd)
+		}
+	}
+	if v, ok := os.LookupEnv("GOAGAIN_TEST_FD"); ok {
+		t.Errorf("GOAGAIN_TEST_FD=%s still set after the restart", v)
+	}
+	if n := len(transferredFiles()); 0 != n {
+		t.Errorf("%d files still marked after the restart", n)
+	}
+}
+
+// Marking a file under a key already in use replaces the first.
+func TestTransferFileEnvReplaces(t *testing.T) {
+	keepEnv(t)
+	defer closeTransferred()
+	for i := 0; i < 2; i++ {
+		r, w, err := os.Pipe()
+		if nil != err {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		defer w.Close()
+		if err := TransferFileEnv(r, "GOAGAIN_TEST_FD"); nil != err {
+			t.Fatal(err)
+		}
+	}
+	files := transferredFiles()
+	if 1 != len(files) {
+		t.Fatalf("%d files marked, want 1", len(files))
+	}
+	if want := fmt.Sprint(files[0].Fd()); want != os.Getenv("GOAGAIN_TEST_FD") {
+		t.Errorf("GOAGAIN_TEST_FD=%s, want %s", os.Getenv("GOAGAIN_TEST_FD"), want)
+	}
+}
+
+// A connection accepted from a GracefulListener, or behind any other
+// wrapper with Unwrap, can be transferred.
+func TestTransferConnUnwraps(t *testing.T) {
+	defer closeTransferred()
+	l := NewGracefulListener(listenTCP(t))
+	c, err := net.Dial("tcp", l.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ac, err := l.Accept()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	for _, tt := range []struct {
+		name string
+		c    net.Conn
+	}{
+		{"graceful", ac},
+		{"nested", wrappedConn{ac}},
+	} {
+		if _, err := TransferConn(tt.c); nil != err {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+	if _, err := TransferConn(wrappedConn{}); nil == err {
+		t.Error("transferred a wrapper around nothing")
+	}
+}
+
+type wrappedConn struct{ net.Conn }
+
+func (c wrappedConn) Unwrap() net.Conn { return c.Conn }
@@ -0,0 +1,49 @@
+package goagain
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Tell our parent we're ready by sending it quitSignal, as Kill does, or the
+// ForkOptions.ReadySignal it recorded, and, if it asked for a clean cutover
+// with ForkOptions.CutoverSignal, block until it has stopped accepting.  Call
+// this after Listener and before accepting.
+func AwaitCutover(quitSignal syscall.Signal) error {
+	quitSignal = readySignal(quitSignal)
+	var sig int
+	if _, err := fmt.Sscan(os.Getenv("GOAGAIN_CUTOVER_SIGNAL"), &sig); nil != err {
+		return Kill(quitSignal)
+	}
+
+	// Listen before signaling so the parent can't beat us to it.
+	goCh := make(chan os.Signal, 1)
+	signal.Notify(goCh, syscall.Signal(sig))
+	defer signal.Stop(goCh)
+	if err := Kill(quitSignal); nil != err {
+		return err
+	}
+	logln("Waiting for parent to stop accepting...")
+	<-goCh
+	return nil
+}
+
+// Stop accepting on ls and tell the child to start.
+func cutover(ls []net.Listener, cp *os.Process, sig syscall.Signal) error {
+	if err := setDeadlines(ls, time.Now()); nil != err {
+		return err
+	}
+	logln("Stopped accepting, cutting over to child", cp.Pid)
+	return cp.Signal(sig)
+}
+
+func setCutoverSignal(opts ForkOptions) error {
+	if 0 == opts.CutoverSignal {
+		return unsetenv("GOAGAIN_CUTOVER_SIGNAL")
+	}
+	return setenv("GOAGAIN_CUTOVER_SIGNAL", fmt.Sprint(int(opts.CutoverSignal)))
+}
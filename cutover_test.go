@@ -0,0 +1,31 @@
+package goagain
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+// Cutting over stops an Accept the parent started after the fork, one the
+// fork mustn't have left blocking in the kernel.
+func TestCutoverAfterFork(t *testing.T) {
+	keepEnv(t)
+	standIn(t, "sleep", 0)
+	l := listenTCP(t)
+	p, _, err := forkExec(handoff{ls: []net.Listener{l}}, syscall.SIGQUIT, ForkOptions{})
+	if nil != err {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		p.Kill()
+		p.Wait()
+	})
+
+	errCh := blockedAccept(l)
+	if err := cutover([]net.Listener{l}, p, syscall.SIGCONT); nil != err {
+		t.Fatal(err)
+	}
+	if err := released(t, l, errCh); !IsErrClosing(err) {
+		t.Fatalf("blocked Accept after cutover: %v", err)
+	}
+}
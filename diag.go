@@ -0,0 +1,114 @@
+package goagain
+
+import (
+	"net"
+	"sync"
+	"syscall"
+)
+
+// What ListenerDiagnostics knows about one listener.
+type ListenerDiag struct {
+	Network, Addr string
+
+	// The listener's file descriptor in this process, or -1 if it can't be
+	// had, as for a listener without a SyscallConn method.
+	Fd int
+
+	// Whether the listener came from a parent or systemd rather than being
+	// bound by this process.
+	Inherited bool
+}
+
+var (
+	trackedMu sync.Mutex
+	tracked   []trackedListener
+)
+
+type trackedListener struct {
+	l         net.Listener
+	inherited bool
+}
+
+// Remember l for ListenerDiagnostics.  A listener that's already tracked
+// keeps its first record so one inherited and then passed to Wait still
+// reads as inherited.
+func track(l net.Listener, inherited bool) {
+	l = unwrap(l)
+	trackedMu.Lock()
+	defer trackedMu.Unlock()
+	pruneClosed()
+	for _, t := range tracked {
+		if t.l == l {
+			return
+		}
+	}
+	tracked = append(tracked, trackedListener{l, inherited})
+}
+
+// Forget the tracked listeners that have been closed, say the parent's
+// after a handoff or those replaced across a standby, so they're neither
+// listed nor kept alive.  Call with trackedMu held.
+func pruneClosed() {
+	open := tracked[:0]
+	for _, t := range tracked {
+		if !isClosed(t.l) {
+			open = append(open, t)
+		}
+	}
+	for i := len(open); i < len(tracked); i++ {
+		tracked[i] = trackedListener{}
+	}
+	tracked = open
+}
+
+// Test whether l has been closed.  Only a listener with a SyscallConn can
+// tell; any other is taken to be open.
+func isClosed(l net.Listener) bool {
+	sc, ok := l.(syscall.Conn)
+	if !ok {
+		return false
+	}
+	rc, err := sc.SyscallConn()
+	if nil != err {
+		return true
+	}
+	return nil != rc.Control(func(uintptr) {})
+}
+
+// Describe every open listener this process inherited or has passed to
+// Wait, in the order goagain first saw them, for a diagnostics endpoint.
+// Comparing Addr and Fd across generations shows whether a socket really is
+// the one inherited.  This reads but never changes any listener.
+func ListenerDiagnostics() []ListenerDiag {
+	trackedMu.Lock()
+	defer trackedMu.Unlock()
+	pruneClosed()
+	diags := make([]ListenerDiag, 0, len(tracked))
+	for _, t := range tracked {
+		addr := t.l.Addr()
+		diags = append(diags, ListenerDiag{
+			Network:   addr.Network(),
+			Addr:      addr.String(),
+			Fd:        listenerFd(t.l),
+			Inherited: t.inherited,
+		})
+	}
+	return diags
+}
+
+// The fd underneath l without dup'ing it, or -1 if it can't be had.
+func listenerFd(l net.Listener) int {
+	sc, ok := l.(syscall.Conn)
+	if !ok {
+		return -1
+	}
+	rc, err := sc.SyscallConn()
+	if nil != err {
+		return -1
+	}
+	fd := -1
+	if err := rc.Control(func(s uintptr) { fd = int(s) }); nil != err {
+		return -1
+	}
+	return fd
+}
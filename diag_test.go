@@ -0,0 +1,45 @@
+package goagain
+
+import "testing"
+
+// A closed listener drops out of the diagnostics and out of the registry
+// that would otherwise keep it alive.
+func TestListenerDiagnosticsDropsClosed(t *testing.T) {
+	trackedMu.Lock()
+	was := tracked
+	tracked = nil
+	trackedMu.Unlock()
+	t.Cleanup(func() {
+		trackedMu.Lock()
+		tracked = was
+		trackedMu.Unlock()
+	})
+
+	kept, gone := listenTCP(t), listenTCP(t)
+	track(kept, false)
+	track(gone, true)
+	gone.Close()
+	diags := ListenerDiagnostics()
+	if 1 != len(diags) || kept.Addr().String() != diags[0].Addr {
+		t.Fatalf("diagnostics %+v, want just %s", diags, kept.Addr())
+	}
+	if diags[0].Fd < 0 {
+		t.Errorf("open listener reported with fd %d", diags[0].Fd)
+	}
+	trackedMu.Lock()
+	n := len(tracked)
+	trackedMu.Unlock()
+	if 1 != n {
+		t.Errorf("%d listeners still tracked, want 1", n)
+	}
+
+	// Tracking another forgets the closed ones too.
+	kept.Close()
+	track(listenTCP(t), false)
+	trackedMu.Lock()
+	n = len(tracked)
+	trackedMu.Unlock()
+	if 1 != n {
+		t.Errorf("%d listeners tracked after closing and tracking, want 1", n)
+	}
+}
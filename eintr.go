@@ -0,0 +1,19 @@
+package goagain
+
+import "syscall"
+
+// Call f until it fails with something other than EINTR, which a signal
+// arriving mid-call can cause and which is no reason to fail a handoff.
+func retryEINTR(f func() error) error {
+	for {
+		if err := f(); syscall.EINTR != err {
+			return err
+		}
+	}
+}
+
+func killRetryEINTR(pid int, sig syscall.Signal) error {
+	return retryEINTR(func() error {
+		return syscall.Kill(pid, sig)
+	})
+}
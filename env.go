@@ -0,0 +1,153 @@
+package goagain
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The handoff state goagain keeps in the environment, parsed.  Each Has field
+// reports whether the corresponding variable was set to a valid value.
+type EnvInfo struct {
+	Fd    uintptr // GOAGAIN_FD, the inherited listener
+	HasFd bool
+
+	Name    string // GOAGAIN_NAME, that listener's name
+	HasName bool
+
+	Pid    int // GOAGAIN_PID, the child we spawned
+	HasPid bool
+
+	Ppid    int // GOAGAIN_PPID, the parent that spawned us
+	HasPpid bool
+
+	Generation    int // GOAGAIN_GENERATION, restarts since the first process
+	HasGeneration bool
+}
+
+// Parse the GOAGAIN_* environment.  Variables that are set but don't parse are
+// each reported in the error, which joins one error per bad variable; the
+// rest of the EnvInfo is still filled in.
+func Env() (EnvInfo, error) {
+	var (
+		info EnvInfo
+		errs []error
+		fd   int
+	)
+	if v, ok := os.LookupEnv("GOAGAIN_NAME"); ok && "" != v {
+		info.Name, info.HasName = v, true
+	}
+	for _, f := range []struct {
+		key string
+		v   *int
+		has *bool
+	}{
+		{"GOAGAIN_FD", &fd, &info.HasFd},
+		{"GOAGAIN_PID", &info.Pid, &info.HasPid},
+		{"GOAGAIN_PPID", &info.Ppid, &info.HasPpid},
+		{"GOAGAIN_GENERATION", &info.Generation, &info.HasGeneration},
+	} {
+		v := os.Getenv(f.key)
+		if "" == v {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if nil != err || n < 0 {
+			errs = append(errs, fmt.Errorf("%s: bad value %q", f.key, v))
+			continue
+		}
+		*f.v, *f.has = n, true
+	}
+	info.Fd = uintptr(fd)
+	return info, errors.Join(errs...)
+}
+
+var (
+	generationOnce sync.Once
+	generation     int
+)
+
+// Record the child's generation, one more than ours.  Ours is read before the
+// first fork overwrites it so every child of this process gets the same one.
+func setGeneration() error {
+	generationOnce.Do(func() {
+		info, _ := Env()
+		generation = info.Generation
+	})
+	return setenv("GOAGAIN_GENERATION", fmt.Sprint(generation+1))
+}
+
+// Every change forkExec makes to the environment goes through these so a
+// failing Setenv can be simulated.
+var (
+	setenv   = os.Setenv
+	unsetenv = os.Unsetenv
+)
+
+// Take a copy of every GOAGAIN_ variable.
+func snapshotEnv() map[string]string {
+	snap := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(k, "GOAGAIN_") {
+			snap[k] = v
+		}
+	}
+	return snap
+}
+
+// Put the GOAGAIN_ variables back as snapshotEnv found them, dropping any
+// set since.  This bypasses the seams: it's the way back from a failure.
+func restoreEnv(snap map[string]string) {
+	for k := range snapshotEnv() {
+		if _, ok := snap[k]; !ok {
+			if err := os.Unsetenv(k); nil != err {
+				logln("Unable to restore", k, err)
+			}
+		}
+	}
+	for k, v := range snap {
+		if err := os.Setenv(k, v); nil != err {
+			logln("Unable to restore", k, err)
+		}
+	}
+}
+
+// The version of the GOAGAIN_ environment this package writes and reads.
+// Bump it whenever a change would make an older child misread it.
+const protocolVersion = 1
+
+// The version of the handoff protocol this build of goagain speaks, stamped
+// on every child as GOAGAIN_PROTO_VERSION.
+func ProtocolVersion() int {
+	return protocolVersion
+}
+
+// Returned when a listener is reconstructed from a parent that speaks a newer
+// protocol than we understand, as when a deploy rolls back to an older binary.
+var ErrProtocolVersion = errors.New("unsupported goagain protocol version")
+
+// Check that we understand the protocol our parent spoke.  Older versions are
+// fine since the protocol only grows; a parent from before the stamp is
+// taken to be version 1.
+func checkProtocolVersion() error {
+	s, ok := os.LookupEnv("GOAGAIN_PROTO_VERSION")
+	if !ok {
+		return nil
+	}
+	v, err := strconv.Atoi(s)
+	if nil != err {
+		return fmt.Errorf("%w: GOAGAIN_PROTO_VERSION %q", ErrProtocolVersion, s)
+	}
+	if v > protocolVersion {
+		return fmt.Errorf(
+			"%w: parent speaks %d but this build only understands up to %d",
+			ErrProtocolVersion,
+			v,
+			protocolVersion,
+		)
+	}
+	return nil
+}
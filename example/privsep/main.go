@@ -0,0 +1,169 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/blamarvt/goagain"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// A privileged helper that binds the socket and never serves, and
+// unprivileged workers that serve and never bind.  On SIGHUP the helper
+// starts a new worker with the same listener and, once it's ready, stops
+// the old one, so the privileged socket is never rebound.  Run it as root:
+//
+//	sudo ./privsep -addr :80 -user nobody
+//
+// Workers can't signal a helper running as another user, so instead of Kill
+// a worker reports readiness by writing a byte to a pipe the helper passes
+// it as fd 3.
+
+var (
+	addr     = flag.String("addr", "127.0.0.1:80", "address for the helper to bind")
+	username = flag.String("user", "nobody", "user for the workers to run as")
+	worker   = flag.Bool("worker", false, "run as a worker (set by the helper)")
+)
+
+func init() {
+	log.SetFlags(log.Lmicroseconds | log.Lshortfile)
+	log.SetPrefix(fmt.Sprintf("pid:%d ", syscall.Getpid()))
+	goagain.Logger = log.Default()
+}
+
+func main() {
+	flag.Parse()
+	if *worker {
+		work()
+	} else {
+		help()
+	}
+}
+
+// The helper: bind, spawn a worker and replace it on every SIGHUP.
+func help() {
+	cred, err := credential(*username)
+	if nil != err {
+		log.Fatalln(err)
+	}
+	l, err := net.Listen("tcp", *addr)
+	if nil != err {
+		log.Fatalln(err)
+	}
+	log.Println("listening on", l.Addr())
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGTERM)
+
+	goagain.OnChildExit = func(pid int, state *os.ProcessState) {
+		log.Println("worker", pid, "gone:", state)
+	}
+	current, err := spawn(l, cred)
+	if nil != err {
+		log.Fatalln(err)
+	}
+	for sig := range sigCh {
+		if syscall.SIGTERM == sig {
+			current.Signal(syscall.SIGTERM)
+			return
+		}
+		next, err := spawn(l, cred)
+		if nil != err {
+			log.Println("new worker failed, keeping", current.Pid, err)
+			continue
+		}
+		log.Println("worker", next.Pid, "ready, stopping", current.Pid)
+		current.Signal(syscall.SIGTERM)
+		current = next
+	}
+}
+
+// Start a worker as cred, passing it l, and wait for it to report ready.
+func spawn(l net.Listener, cred *syscall.Credential) (*os.Process, error) {
+	r, w, err := os.Pipe()
+	if nil != err {
+		return nil, err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(os.Args[0], append([]string{"-worker"}, os.Args[1:]...)...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+	p, err := goagain.SpawnWith(cmd, l)
+	w.Close()
+	if nil != err {
+		return nil, err
+	}
+
+	// A worker that dies first closes the pipe and the read fails.
+	r.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := r.Read(make([]byte, 1)); nil != err {
+		p.Kill()
+		return nil, fmt.Errorf("worker %d never became ready: %v", p.Pid, err)
+	}
+	return p, nil
+}
+
+// The credential to run workers as.
+func credential(name string) (*syscall.Credential, error) {
+	u, err := user.Lookup(name)
+	if nil != err {
+		return nil, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if nil != err {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if nil != err {
+		return nil, err
+	}
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}, nil
+}
+
+// A worker: serve the listener the helper passed until SIGTERM.
+func work() {
+	ls, err := goagain.Listeners()
+	if nil != err {
+		log.Fatalln(err)
+	}
+	l := goagain.NewGracefulListener(ls[0])
+	log.Println("serving on", l.Addr(), "as uid", syscall.Getuid())
+	go serve(l)
+
+	stopCh := make(chan os.Signal, 1)
+	signal.Notify(stopCh, syscall.SIGTERM)
+
+	ready := os.NewFile(3, "ready")
+	ready.Write([]byte{1})
+	ready.Close()
+
+	<-stopCh
+	l.Close()
+	if err := l.Drain(10 * time.Second); nil != err {
+		log.Println(err)
+	}
+}
+
+// A very rude server that says hello and then closes your connection.
+func serve(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if nil != err {
+			if goagain.IsErrClosing(err) {
+				break
+			}
+			log.Fatalln(err)
+		}
+		c.Write([]byte("Hello, world!\n"))
+		c.Close()
+	}
+}
@@ -12,10 +12,15 @@ import (
 func init() {
 	log.SetFlags(log.Lmicroseconds | log.Lshortfile)
 	log.SetPrefix(fmt.Sprintf("pid:%d ", syscall.Getpid()))
+	goagain.Logger = log.Default()
 }
 
 func main() {
 
+	// Catch the fork signal before doing anything slow so an early one
+	// isn't lost.
+	goagain.Init(syscall.SIGHUP)
+
 	// Inherit a net.Listener from our parent process or listen anew.
 	l, err := goagain.Listener()
 	if nil != err {
@@ -43,11 +48,14 @@ func main() {
 
 	}
 
-	forkSig := syscall.SIGHUP
-	quitSig := syscall.SIGQUIT
+	h := goagain.NewWithConfig(goagain.Config{
+		ForkSignal: syscall.SIGHUP,
+		QuitSignal: syscall.SIGQUIT,
+		Timeout:    10 * time.Second,
+	})
 
 	// Block the main goroutine awaiting signals.
-	if err := goagain.Wait(l, forkSig, quitSig); err != nil {
+	if err := h.Wait(l); err != nil {
 		log.Fatalln(err)
 	}
 
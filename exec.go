@@ -0,0 +1,96 @@
+package goagain
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// How a child was exec'd, for telling which binary and flags a restart
+// really ran.  Anything that looks like a secret is already redacted.
+type ExecInfo struct {
+	// The resolved path exec'd and the argv it was given.
+	Argv0 string
+	Args  []string
+
+	// The child's working directory.
+	Dir string
+
+	// The ForkOptions.EnvOverride variables the child got.
+	Env map[string]string
+}
+
+const redacted = "<redacted>"
+
+// Substrings of a variable or flag name taken to mean its value is a secret.
+var secretWords = []string{
+	"secret", "token", "passw", "pwd", "key", "credential", "auth", "private",
+}
+
+func looksSecret(name string) bool {
+	name = strings.ToLower(name)
+	for _, w := range secretWords {
+		if strings.Contains(name, w) {
+			return true
+		}
+	}
+	return false
+}
+
+func newExecInfo(argv0 string, argv []string, dir string, opts ForkOptions) *ExecInfo {
+	e := &ExecInfo{Argv0: argv0, Args: redactArgs(argv), Dir: dir}
+	for k, v := range opts.EnvOverride {
+		if strings.HasPrefix(k, "GOAGAIN_") {
+			continue
+		}
+		if nil == e.Env {
+			e.Env = make(map[string]string)
+		}
+		if looksSecret(k) {
+			v = redacted
+		}
+		e.Env[k] = v
+	}
+	return e
+}
+
+// Copy argv, redacting the value of any secret-looking flag, whether given
+// as -flag=value or as the argument after a bare -flag.
+func redactArgs(argv []string) []string {
+	args := make([]string, len(argv))
+	copy(args, argv)
+	for i := 1; i < len(args); i++ {
+		a := args[i]
+		if "--" == a {
+			break
+		}
+		if !strings.HasPrefix(a, "-") {
+			continue
+		}
+		name, _, hasValue := strings.Cut(strings.TrimLeft(a, "-"), "=")
+		if !looksSecret(name) {
+			continue
+		}
+		if hasValue {
+			args[i] = a[:strings.Index(a, "=")+1] + redacted
+		} else if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+			i++
+			args[i] = redacted
+		}
+	}
+	return args
+}
+
+func (e *ExecInfo) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %q in %s", e.Argv0, e.Args, e.Dir)
+	keys := make([]string, 0, len(e.Env))
+	for k := range e.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%q", k, e.Env[k])
+	}
+	return b.String()
+}
@@ -0,0 +1,56 @@
+package goagain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Returned by Wait when Config.ExternalReady didn't report the child ready
+// within ExternalReadyTimeout.  The child has been killed and the caller
+// should keep serving.
+var ErrNotExternallyReady = errors.New("child never became externally ready")
+
+// Poll Config.ExternalReady until it reports the child ready, killing the
+// child if it doesn't by ExternalReadyTimeout.  We keep serving meanwhile, so
+// nothing is lost while the load balancer makes up its mind.  An error from
+// the poll counts as not ready yet, since a load balancer's API can be as
+// flaky as anything, but the last one is reported if time runs out.
+func (h *Handler) awaitExternalReady(ctx context.Context, cp *os.Process, exited <-chan struct{}) error {
+	tick := time.NewTicker(h.cfg.ExternalReadyInterval)
+	defer tick.Stop()
+	deadline := time.After(h.cfg.ExternalReadyTimeout)
+	logln("Waiting for child", cp.Pid, "to be externally ready...")
+	var lastErr error
+	for {
+		ready, err := h.cfg.ExternalReady()
+		if nil == err && ready {
+			logln("Child", cp.Pid, "is externally ready.")
+			return nil
+		}
+		if nil != err && (nil == lastErr || err.Error() != lastErr.Error()) {
+			logln("External readiness check failed:", err)
+		}
+		lastErr = err
+		select {
+		case <-tick.C:
+			continue
+		case <-exited:
+			return fmt.Errorf("%w: pid %d while waiting for external readiness", ErrChildDied, cp.Pid)
+		case <-deadline:
+			err = fmt.Errorf("%w: child %d after %v", ErrNotExternallyReady, cp.Pid, h.cfg.ExternalReadyTimeout)
+			if nil != lastErr {
+				err = fmt.Errorf("%w: last check: %w", err, lastErr)
+			}
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		logln(err)
+		if kErr := cp.Kill(); nil != kErr {
+			logln("Unable to kill process after it never became externally ready", kErr)
+		}
+		return err
+	}
+}
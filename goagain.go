@@ -2,22 +2,84 @@
 package goagain
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
+// Where goagain logs what it's doing.  Nil, the default, keeps it quiet;
+// assign a *log.Logger, say log.Default(), to opt in.
 var Logger *log.Logger
 
-func init() {
-	Logger = log.New(os.Stderr, "", log.LstdFlags)
-}
+// Resolve the binary to re-exec when ForkOptions.Argv0 isn't set.  The default
+// looks up os.Args[0] in PATH; replace it to resolve differently, e.g. via a
+// configured absolute path.
+var LookPath func() (string, error) = lookPath
+
+// Start the child for forkExec, a seam so tests can stand in for the fork.
+var startProcess = os.StartProcess
+
+// The stage at which forkExec failed, for use with errors.Is on the error
+// Wait returns.  A missing binary calls for a different response than a
+// process table or fd limit hit by StartProcess.
+var (
+	ErrLookPath     = errors.New("resolving the binary failed")
+	ErrSetEnv       = errors.New("preparing the child's environment failed")
+	ErrStartProcess = errors.New("starting the child failed")
+)
+
+// Returned by WaitRebind for an address with port 0: the child's fresh bind
+// would get a different port from the parent's.  Pass the listener with Wait
+// instead, which keeps the port since it's the same socket.
+var ErrEphemeralRebind = errors.New("cannot rebind an ephemeral port")
+
+// Returned by Kill when the environment names no process to signal.
+var ErrNoKillTarget = errors.New("no GOAGAIN_PID or GOAGAIN_PPID to signal")
+
+// Returned by Wait, wrapping Config.Verify's error, when the child failed
+// verification after signaling ready.  The child has been killed and the
+// caller should keep serving.
+var ErrVerifyFailed = errors.New("child failed verification")
+
+// Returned by Wait, wrapping Config.CompatCheck's error, when the child
+// doesn't speak the protocol it should.  As with ErrVerifyFailed the child
+// has been killed and the caller should keep serving.
+var ErrIncompatible = errors.New("child failed the compatibility check")
+
+// Returned by Wait when the child died during the standby window.  The caller
+// is the live generation again and should resume accepting on its listener.
+var ErrChildExited = errors.New("child exited during standby")
+
+// Returned by Wait when the child exited before sending the quit signal.
+var ErrChildDied = errors.New("child exited before it was ready")
+
+// Returned by Wait when the child sent neither the quit nor the abort signal
+// within Config.Timeout.  The child has been killed and the caller should
+// keep serving.
+var ErrReadyTimeout = errors.New("timed out waiting for the child to be ready")
+
+// Returned by Wait for a fork signal that arrives before this process has
+// been up for Config.MinUptime.  No child is forked and the caller should
+// keep serving.
+var ErrRestartTooSoon = errors.New("restart refused: process too young")
+
+// When this process started, near enough, for Config.MinUptime.
+var processStart = time.Now()
+
+// Returned by Wait when the child sent the abort signal.  The child has been
+// killed and the caller should keep serving.
+var ErrRestartAborted = errors.New("child aborted the restart")
 
 func logln(v ...interface{}) {
 	if Logger != nil {
@@ -26,42 +88,294 @@ func logln(v ...interface{}) {
 }
 
 // Test whether an error is equivalent to net.errClosing as returned by
-// Accept during a graceful exit.
+// Accept during a graceful exit.  This holds for TCP and Unix listeners alike,
+// and for the timeout Accept returns once a deadline has been set to stop
+// accepting, as during ForkOptions.StandbyDuration.  An http.Server's Serve
+// reports its shutdown as http.ErrServerClosed instead, which
+// IsGracefulClose also covers.
 func IsErrClosing(err error) bool {
+	if nil == err {
+		return false
+	}
+	if errors.Is(err, net.ErrClosed) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	}
 	if opErr, ok := err.(*net.OpError); ok {
 		err = opErr.Err
 	}
 	return "use of closed network connection" == err.Error()
 }
 
+// The message of http.ErrServerClosed, matched rather than the value itself
+// so this package needn't import net/http.
+const errServerClosed = "http: Server closed"
+
+// Test whether err just means a server stopped because its generation is
+// handing off: IsErrClosing's conditions, for a raw Accept loop, or
+// http.ErrServerClosed, which http.Server.Serve returns after Shutdown or
+// Close.  Use this where one loop may serve either kind; IsErrClosing is
+// enough for a loop around Accept alone.
+func IsGracefulClose(err error) bool {
+	if IsErrClosing(err) {
+		return true
+	}
+	for ; nil != err; err = errors.Unwrap(err) {
+		if errServerClosed == err.Error() {
+			return true
+		}
+	}
+	return false
+}
+
+// Tell our parent we can't take over so it keeps serving, using the abort
+// signal it recorded in the environment.  Call this instead of Kill when
+// startup fails after Listener succeeded, then exit.
+func SignalAbort() error {
+	if reportSharedState(shmAbort) {
+		return nil
+	}
+	var sig int
+	if _, err := fmt.Sscan(os.Getenv("GOAGAIN_ABORT_SIGNAL"), &sig); nil != err {
+		return fmt.Errorf("no abort signal in the environment: %v", err)
+	}
+	return Kill(syscall.Signal(sig))
+}
+
 // Kill process specified in the environment with the signal specified in the
-// environment; default to SIGQUIT.
+// environment; default to SIGQUIT.  A parent using Config.SharedMemory is
+// told through that instead and sig is ignored.
 func Kill(sig syscall.Signal) error {
-	var (
-		pid int
-	)
-	_, err := fmt.Sscan(os.Getenv("GOAGAIN_PID"), &pid)
-	if io.EOF == err {
-		_, err = fmt.Sscan(os.Getenv("GOAGAIN_PPID"), &pid)
+	if "" == os.Getenv("GOAGAIN_PID") {
+		sendAddrReport()
+	}
+	if reportSharedState(shmReady) {
+		return nil
 	}
+	pid, err := killTarget()
 	if nil != err {
 		return err
 	}
 	logln("sending signal", sig, "to process", pid)
-	return syscall.Kill(pid, sig)
+	return killRetryEINTR(pid, sig)
+}
+
+// Returned by KillGroup when the process Kill would signal doesn't lead a
+// process group of its own, so signaling the group would hit bystanders.
+var ErrNotGroupLeader = errors.New("target does not lead its own process group")
+
+// Signal the whole process group of the process Kill would signal, say to
+// take a child's worker subprocesses down with it.  The target must lead its
+// group: a child started with ForkOptions.Setpgid does, and a parent does if
+// it was started as a group leader, as a shell does for each job.
+// Otherwise KillGroup returns ErrNotGroupLeader and signals nothing.
+// Config.SharedMemory doesn't apply here.
+func KillGroup(sig syscall.Signal) error {
+	pid, err := killTarget()
+	if nil != err {
+		return err
+	}
+	pgid, err := syscall.Getpgid(pid)
+	if nil != err {
+		return err
+	}
+	if pgid != pid {
+		return fmt.Errorf("%w: process %d is in group %d", ErrNotGroupLeader, pid, pgid)
+	}
+	logln("sending signal", sig, "to process group", pgid)
+	return killRetryEINTR(-pgid, sig)
+}
+
+// The process Kill signals: the child we spawned, else the parent that spawned
+// us.  If both are missing or corrupt but we were evidently started by
+// goagain, fall back to our actual parent process so the handoff can still
+// complete.
+func killTarget() (int, error) {
+	for _, key := range []string{"GOAGAIN_PID", "GOAGAIN_PPID"} {
+		var pid int
+		if _, err := fmt.Sscan(os.Getenv(key), &pid); nil == err && 0 < pid {
+			return pid, nil
+		}
+	}
+	_, fd := os.LookupEnv("GOAGAIN_FD")
+	_, rebind := os.LookupEnv("GOAGAIN_REBIND")
+	if ppid := syscall.Getppid(); (fd || rebind) && 1 < ppid {
+		logln("no usable GOAGAIN_PID or GOAGAIN_PPID, falling back to", ppid)
+		return ppid, nil
+	}
+	return 0, ErrNoKillTarget
+}
+
+// Options controlling how the child is forked and exec'd.
+type ForkOptions struct {
+
+	// Pin the child's GOMAXPROCS to the parent's current value rather than
+	// letting the runtime recompute it.  Useful when it was set
+	// programmatically, e.g. from cgroup limits.
+	GOMAXPROCS bool
+
+	// Keep the parent around as a warm standby for this long after the child
+	// takes over.  The listener's deadline is set so Accept fails with a
+	// timeout and the parent stops accepting; if the child exits within the
+	// window the deadline is cleared and Wait returns ErrChildExited so the
+	// parent can resume.  Both generations hold their memory, goroutines and
+	// fds for the whole window, so keep it short.
+	StandbyDuration time.Duration
+
+	// Exec this binary instead of the current one, e.g. to swap in a build
+	// with a different name during a blue/green deploy.  It must understand
+	// the GOAGAIN_* environment.  Defaults to os.Args[0] as found in PATH.
+	Argv0 string
+
+	// Re-exec the running image itself rather than whatever os.Args[0]
+	// names now, for a binary launched from a sealed memfd, which has no
+	// path to find again, or any deploy that must never pick up a new build
+	// by accident.  Linux only, via /proc/self/exe; elsewhere the restart
+	// fails with ErrLookPath.  A memfd launch is detected and handled this
+	// way without it.
+	ReexecSelf bool
+
+	// Start the child in a process group of its own, with it as the
+	// leader, so KillGroup can reach it together with any workers it
+	// spawns.  A terminal's signals, such as ^C, then reach the parent's
+	// group but not the child's.
+	Setpgid bool
+
+	// Whether to kill the child if forkExec fails after starting it, say
+	// because recording its pid in our environment failed.  Nil, the
+	// default, means true, as before the option existed.  Point it at false
+	// to leave the child running: Wait still returns the error and
+	// RestartResult.NewPid names the child, which from then on is the
+	// caller's to deal with.  goagain only reaps it.  Meanwhile it holds
+	// dups of every passed listener and may accept on them from a
+	// half-finished setup.  It may also send its quit signal at a parent no
+	// longer listening for one, which with SIGQUIT's default disposition
+	// kills the parent.
+	KillChildOnSetupError *bool
+
+	// The net.ListenConfig.KeepAlive the listener was created with.  It's a
+	// property of the ListenConfig, not the socket, so it's recorded in the
+	// environment and re-applied to connections the child accepts.  Zero
+	// leaves Go's default in place.
+	KeepAlive time.Duration
+
+	// The signal a child sends with SignalAbort when it can't take over, so
+	// the parent rolls back right away instead of waiting out the timeout.
+	// Zero disables it.
+	AbortSignal syscall.Signal
+
+	// Cut over cleanly instead of letting both generations accept at once:
+	// once the child is ready the parent stops accepting, as in standby, and
+	// only then sends the child this signal, on which the child's
+	// AwaitCutover returns and it starts accepting.  Connections queue in
+	// the kernel during the brief gap.  Zero keeps the overlap.
+	CutoverSignal syscall.Signal
+
+	// The signal the child sends, with SignalReady, to confirm it has taken
+	// over, in place of Config.QuitSignal.  By default the two are the
+	// same, so an operator who sends the parent SIGQUIT can't be told apart
+	// from a child that's ready: mid-restart it's taken as the child's
+	// confirmation, and otherwise there's no handler and the parent dies.
+	// A signal of its own, say SIGUSR1, leaves QuitSignal to the
+	// application, say for GracefulStop.  Zero uses QuitSignal.
+	ReadySignal syscall.Signal
+
+	// The child's working directory.  Defaults to ours, or, if that's been
+	// deleted as when an old release directory is pruned, the directory
+	// holding the binary and failing that /.
+	Dir string
+
+	// Variables to add to or override in the child's environment, which is
+	// otherwise ours, say to bump a config flag.  GOAGAIN_ variables are
+	// goagain's own and can't be overridden.
+	EnvOverride map[string]string
+
+	// The fork signal to catch from startup so a restart queued for the
+	// child isn't lost, set per restart with Config.QueueRestarts.
+	queueSignal syscall.Signal
 }
 
 // Reconstruct a net.Listener from a file descriptior and name specified in the
 // environment.  Deal with Go's insistence on dup(2)ing file descriptors.
+// Since it's the parent's very socket, its Addr is the concrete address the
+// parent resolved, including the port the OS assigned if it bound port 0.
 func Listener() (l net.Listener, err error) {
+	if err = checkProtocolVersion(); nil != err {
+		return
+	}
+	inheritGOMAXPROCS()
 	var fd uintptr
 	if _, err = fmt.Sscan(os.Getenv("GOAGAIN_FD"), &fd); nil != err {
 		return
 	}
+	if l, err = fileListener(
+		fd,
+		os.Getenv("GOAGAIN_NAME"),
+		os.Getenv("GOAGAIN_NET"),
+		os.Getenv("GOAGAIN_INODE"),
+	); nil != err {
+		return
+	}
+	l = inheritKeepAlive(l)
+	l = inheritName(l, os.Getenv("GOAGAIN_FDNAME"))
+	return
+}
+
+// Reconstruct the inherited listener as a *net.TCPListener, failing if our
+// parent passed anything else.  The concrete type drops Listener's wrappers,
+// so a GOAGAIN_KEEPALIVE period isn't applied and ListenerName doesn't know
+// the listener's name.
+func TCPListener() (*net.TCPListener, error) {
+	l, err := Listener()
+	if nil != err {
+		return nil, err
+	}
+	tl, ok := unwrap(l).(*net.TCPListener)
+	if !ok {
+		l.Close()
+		return nil, fmt.Errorf("inherited listener is %T not *net.TCPListener", unwrap(l))
+	}
+	return tl, nil
+}
+
+// Reconstruct the inherited listener as a *net.UnixListener, as TCPListener
+// does for TCP.
+func UnixListener() (*net.UnixListener, error) {
+	l, err := Listener()
+	if nil != err {
+		return nil, err
+	}
+	ul, ok := unwrap(l).(*net.UnixListener)
+	if !ok {
+		l.Close()
+		return nil, fmt.Errorf("inherited listener is %T not *net.UnixListener", unwrap(l))
+	}
+	return ul, nil
+}
+
+// Reconstruct a TCP or Unix net.Listener, or one on a network registered
+// with RegisterNetwork, from an inherited file descriptor, which the parent
+// recorded as a socket on network with the given inode.
+func fileListener(fd uintptr, name, network, inode string) (l net.Listener, err error) {
+	custom := registeredNetwork(network)
+	if nil == custom {
+		err = checkSocketType(fd, network)
+	}
+	if nil != err {
+		return
+	}
+	if err = checkSocketInode(fd, inode); nil != err {
+		return
+	}
 	// NewFile takes over the fd but FileListener makes its own copy. Make sure
 	// to clean up the former.
-	fdf := os.NewFile(fd, os.Getenv("GOAGAIN_NAME"))
+	fdf := os.NewFile(fd, name)
 	defer fdf.Close()
+	if nil != custom {
+		if l, err = custom(fdf); nil == err {
+			track(l, true)
+		}
+		return
+	}
 	l, err = net.FileListener(fdf)
 	if nil != err {
 		return
@@ -75,134 +389,1203 @@ func Listener() (l net.Listener, err error) {
 		)
 		return
 	}
+	track(l, true)
 	return
 }
 
+// Test whether a net.Listener can be passed to a child, that is whether it's
+// backed by a file descriptor we know how to extract.  Wait checks this up
+// front so a bad listener is reported at setup rather than when a restart is
+// attempted.
+func Validate(l net.Listener) error {
+	switch u := unwrap(l).(type) {
+	case *net.TCPListener, *net.UnixListener:
+		return nil
+	default:
+		if _, ok := customFiler(u); ok {
+			return nil
+		}
+	}
+	return fmt.Errorf(
+		"listener is %T not *net.TCPListener or *net.UnixListener nor wraps one with Unwrap() net.Listener",
+		l,
+	)
+}
+
+// Drill down through listeners that wrap others to the one holding the
+// socket.  A wrapper, such as the one Listener returns when a keep-alive was
+// recorded or PROXY protocol middleware that embeds a net.Listener, opts in
+// by implementing Unwrap() net.Listener, the convention errors.Unwrap
+// follows for errors.  goagain takes the fd from whatever is at the bottom
+// and leaves the wrappers to keep serving.
+func unwrap(l net.Listener) net.Listener {
+	for {
+		u, ok := l.(interface {
+			Unwrap() net.Listener
+		})
+		if !ok {
+			return l
+		}
+		next := u.Unwrap()
+		if nil == next || next == l {
+			return l
+		}
+		l = next
+	}
+}
+
+// Release anything goagain holds for a handoff that hasn't happened:
+// connections and files marked with TransferConn or TransferFile and the
+// signal handlers registered by Init.  Call it once done restarting, say
+// before exiting after a successful handoff.  The listeners passed to Wait
+// are the caller's and are left alone.
+func Cleanup() {
+	closeTransferred()
+	earlyMu.Lock()
+	defer earlyMu.Unlock()
+	for sig, ch := range early {
+		signal.Stop(ch)
+		delete(early, sig)
+	}
+}
+
 // Fork and exec this same image without dropping the net.Listener.
-func forkExec(l net.Listener, quitSignal syscall.Signal) (*os.Process, error) {
-	argv0, err := lookPath()
+//
+// The environment is rewritten for the child along the way.  If anything
+// fails, the GOAGAIN_ variables are put back as they were so a retry starts
+// from the same state.
+func forkExec(t handoff, quitSignal syscall.Signal, opts ForkOptions) (p *os.Process, info *ExecInfo, err error) {
+	snap := snapshotEnv()
+	defer func() {
+		if nil != err {
+			restoreEnv(snap)
+		}
+	}()
+	argv0, argv, err := resolveArgv(opts)
 	if nil != err {
-		return nil, err
+		return nil, info, fmt.Errorf("%w: %w", ErrLookPath, err)
 	}
-	wd, err := os.Getwd()
+	wd := childDir(opts, argv0)
+	info = newExecInfo(argv0, argv, wd, opts)
+	lfs, err := t.setEnvs()
 	if nil != err {
-		return nil, err
+		return nil, info, fmt.Errorf("%w: %w", ErrSetEnv, err)
 	}
-	fd, err := setEnvs(l)
-	if nil != err {
-		return nil, err
+
+	// These are dups of the listeners' fds just for the child.  The
+	// listeners themselves stay open and usable; the dups mustn't outlive
+	// the fork or a long-lived parent runs out of fds.
+	defer closeFiles(lfs)
+	if err := setenv("GOAGAIN_PROTO_VERSION", fmt.Sprint(protocolVersion)); nil != err {
+		return nil, info, fmt.Errorf("%w: %w", ErrSetEnv, err)
 	}
-	if err := os.Setenv("GOAGAIN_PID", ""); nil != err {
-		return nil, err
+	if err := setenv("GOAGAIN_PID", ""); nil != err {
+		return nil, info, fmt.Errorf("%w: %w", ErrSetEnv, err)
 	}
-	if err := os.Setenv(
+	if err := setenv(
 		"GOAGAIN_PPID",
 		fmt.Sprint(syscall.Getpid()),
 	); nil != err {
-		return nil, err
+		return nil, info, fmt.Errorf("%w: %w", ErrSetEnv, err)
+	}
+	if err := setGeneration(); nil != err {
+		return nil, info, fmt.Errorf("%w: %w", ErrSetEnv, err)
+	}
+	if err := setAncestors(); nil != err {
+		return nil, info, fmt.Errorf("%w: %w", ErrSetEnv, err)
+	}
+	for _, set := range optionEnvs {
+		if err := set(opts); nil != err {
+			return nil, info, fmt.Errorf("%w: %w", ErrSetEnv, err)
+		}
+	}
+	// Each file is passed at the same fd number in the child.
+	passed := append(lfs, transferredFiles()...)
+
+	// os.StartProcess calls Fd on every file, putting the sockets behind
+	// these dups in blocking mode, the parent's own listeners and
+	// connections included.  Put them back once the child has started, or
+	// an Accept goes on to block in the kernel, beyond the reach of
+	// deadlines and Close.  One that enters the kernel during the fork is
+	// only let go by the next connection.
+	nb := nonblockingFds(passed)
+	if nil != t.shm {
+		passed = append(passed, t.shm.f)
+	}
+	if nil != t.report {
+		passed = append(passed, t.report.w)
 	}
-	files := make([]*os.File, fd+1)
+	fds := make([]uintptr, len(passed))
+	n := uintptr(syscall.Stderr)
+	for i, f := range passed {
+		if fds[i] = sysfd(f); fds[i] > n {
+			n = fds[i]
+		}
+	}
+	files := make([]*os.File, n+1)
 	files[syscall.Stdin] = os.Stdin
 	files[syscall.Stdout] = os.Stdout
 	files[syscall.Stderr] = os.Stderr
-	addr := l.Addr()
-	files[fd] = os.NewFile(
-		fd,
-		fmt.Sprintf("%s:%s->", addr.Network(), addr.String()),
-	)
-	p, err := os.StartProcess(argv0, os.Args, &os.ProcAttr{
+	// Hand over the very files setEnvs got from File().  A second os.File
+	// for the same fd would close it out from under the first when collected.
+	for i, f := range passed {
+		files[fds[i]] = f
+	}
+	logln("exec", info)
+	p, err = startProcess(argv0, argv, &os.ProcAttr{
 		Dir:   wd,
-		Env:   os.Environ(),
+		Env:   childEnv(opts),
 		Files: files,
-		Sys:   &syscall.SysProcAttr{},
+		Sys:   &syscall.SysProcAttr{Setpgid: opts.Setpgid},
 	})
+	nb.restore()
 	if nil != err {
-		return nil, err
+		return nil, info, fmt.Errorf("%w: %w", ErrStartProcess, err)
 	}
 	logln("spawned child", p.Pid)
-	if err = os.Setenv("GOAGAIN_PID", fmt.Sprint(p.Pid)); nil != err {
-		return p, err
+	if err = setenv("GOAGAIN_PID", fmt.Sprint(p.Pid)); nil != err {
+		return p, info, fmt.Errorf("%w: %w", ErrSetEnv, err)
 	}
-	return p, nil
+	return p, info, nil
 }
 
+// Block until forkSignal, fork a child that inherits l and wait for it to
+// send quitSignal, after which the caller should stop serving and exit.  This
+// is NewWithConfig(...).Wait(l) for callers that need nothing else.  A zero
+// timeout now waits for quitSignal indefinitely, as Config.Timeout does; it
+// used to mean not waiting at all.
 func Wait(l net.Listener, forkSignal syscall.Signal, quitSignal syscall.Signal, timeout time.Duration) error {
-	forkCh := make(chan os.Signal, 1)
-	signal.Notify(forkCh, forkSignal)
+	return WaitWithOptions(l, forkSignal, quitSignal, timeout, ForkOptions{})
+}
+
+// Wait like Wait but fork the child according to opts.
+func WaitWithOptions(l net.Listener, forkSignal syscall.Signal, quitSignal syscall.Signal, timeout time.Duration, opts ForkOptions) error {
+	return NewWithConfig(Config{
+		ForkSignal:  forkSignal,
+		QuitSignal:  quitSignal,
+		Timeout:     timeout,
+		ForkOptions: opts,
+	}).Wait(l)
+}
+
+// The number of Handlers in this process between a fork signal and the end of
+// the restart it triggered.
+var restarting int32
+
+// Test whether any restart is in progress in this process, for instance to
+// report a transient state from a health check during the handoff.
+func Restarting() bool {
+	return 0 < atomic.LoadInt32(&restarting)
+}
+
+// Test whether this Handler is between a fork signal and the end of the
+// restart it triggered.
+func (h *Handler) Restarting() bool {
+	return h.restarting.Load()
+}
+
+// Block until the fork signal, fork a child that inherits l and wait for it
+// to send the quit signal, after which the caller should stop serving and
+// exit.  A Handler may Wait any number of times in succession.
+//
+// Wait never touches l before the quit signal so the caller should keep
+// accepting throughout and only close l once Wait returns nil.  Until then
+// both generations accept; see the handoff sequence in the README.
+func (h *Handler) Wait(l net.Listener) error {
+	return h.WaitContext(context.Background(), l)
+}
+
+// Wait for and carry out up to n restarts in turn, for bounded-lifetime
+// deployments or tests exercising several handoffs, returning after the nth
+// or at the first failure.  Each restart registers its signal handlers
+// afresh and stops them when done.
+func (h *Handler) WaitN(n int, l net.Listener) error {
+	for i := 0; i < n; i++ {
+		if err := h.Wait(l); nil != err {
+			return err
+		}
+		logln("Completed restart", i+1, "of", n)
+	}
+	return nil
+}
+
+// Wait like Wait but give up when ctx is done.  Before the fork signal that
+// just means returning ctx.Err(); afterwards the child is killed and the
+// caller keeps serving, as with Config.Deadline.
+func (h *Handler) WaitContext(ctx context.Context, l net.Listener) error {
+	if err := Validate(l); nil != err {
+		return err
+	}
+	return h.wait(ctx, handoff{ls: []net.Listener{l}})
+}
+
+// Wait like Wait but take the fork and quit signals from the caller's own
+// channels.  This is NewWithConfig(...).WaitWithChannel(fork, quit, l).
+func WaitWithChannel(fork, quit <-chan os.Signal, l net.Listener, timeout time.Duration) error {
+	return NewWithConfig(Config{Timeout: timeout}).WaitWithChannel(fork, quit, l)
+}
+
+// Wait like Wait but receive the fork and quit signals from fork and quit
+// instead of calling signal.Notify for them.
+//
+// signal.Notify is process-wide: every channel registered for a signal gets
+// a copy, and signal.Stop or signal.Reset elsewhere can leave Wait deaf.
+// Wait in its own goroutine works alongside other handlers, but a program
+// that manages signals in one place can feed goagain through this instead,
+// forwarding Config.ForkSignal to fork and Config.QuitSignal, or ReadySignal
+// if set, to quit.  quit should only carry the child's confirmation during a
+// restart; anything pending on it when the restart begins is discarded.
+// AbortSignal and CutoverSignal are still registered by goagain.
+func (h *Handler) WaitWithChannel(fork, quit <-chan os.Signal, l net.Listener) error {
+	if nil == fork || nil == quit {
+		return errors.New("WaitWithChannel needs both a fork and a quit channel")
+	}
+	if err := Validate(l); nil != err {
+		return err
+	}
+	return h.waitOn(context.Background(), handoff{ls: []net.Listener{l}}, fork, quit)
+}
+
+// Discard whatever signals ch already holds.
+func drainSignals(ch <-chan os.Signal) {
+	for {
+		select {
+		case <-ch:
+		default:
+			return
+		}
+	}
+}
+
+// Block until forkSignal, fork a child that binds network and addr itself,
+// with ListenReusePort or via Rebind, and wait for it to send quitSignal.
+// This is NewWithConfig(...).WaitRebind(network, addr).
+func WaitRebind(network, addr string, forkSignal syscall.Signal, quitSignal syscall.Signal, timeout time.Duration) error {
+	return NewWithConfig(Config{
+		ForkSignal: forkSignal,
+		QuitSignal: quitSignal,
+		Timeout:    timeout,
+	}).WaitRebind(network, addr)
+}
+
+// Restart like Wait but without passing the listener: the child binds its
+// own socket on network and addr, typically with SO_REUSEPORT so both
+// generations can be bound during the overlap, and sends the quit signal
+// once it's accepting.  The parent must have bound with ListenReusePort too.
+func (h *Handler) WaitRebind(network, addr string) error {
+	if 0 < h.cfg.StandbyDuration {
+		return errors.New("StandbyDuration needs a listener to pause")
+	}
+	if 0 != h.cfg.CutoverSignal {
+		return errors.New("CutoverSignal needs a listener to stop")
+	}
+	if isEphemeral(network, addr) {
+		return ErrEphemeralRebind
+	}
+	return h.wait(context.Background(), handoff{network: network, addr: addr})
+}
+
+// Our environment with ForkOptions.EnvOverride applied on top, minus any
+// override of a GOAGAIN_ variable.
+func childEnv(opts ForkOptions) []string {
+	env := os.Environ()
+	if 0 == len(opts.EnvOverride) {
+		return env
+	}
+	for i, kv := range env {
+		k, _, _ := strings.Cut(kv, "=")
+		if v, ok := opts.EnvOverride[k]; ok && !strings.HasPrefix(k, "GOAGAIN_") {
+			env[i] = k + "=" + v
+		}
+	}
+	for k, v := range opts.EnvOverride {
+		if strings.HasPrefix(k, "GOAGAIN_") {
+			logln("Ignoring EnvOverride of", k)
+			continue
+		}
+		if _, ok := os.LookupEnv(k); !ok {
+			env = append(env, k+"="+v)
+		}
+	}
+	return env
+}
+
+// Test whether addr asks for an OS-assigned port, which a fresh bind would
+// assign differently.
+func isEphemeral(network, addr string) bool {
+	switch network {
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+	default:
+		return false
+	}
+	_, port, err := net.SplitHostPort(addr)
+	return nil == err && ("" == port || "0" == port)
+}
+
+// The restart state machine shared by every way of waiting.
+func (h *Handler) wait(ctx context.Context, t handoff) error {
+	return h.waitOn(ctx, t, nil, nil)
+}
+
+// Run the restart state machine, receiving the fork and quit signals from
+// forkCh and quitCh or, where they're nil, from channels of our own.
+func (h *Handler) waitOn(ctx context.Context, t handoff, forkCh, quitCh <-chan os.Signal) error {
+	if err := h.cfg.checkStoppable(t.ls); nil != err {
+		return err
+	}
+	for _, l := range t.ls {
+		track(l, false)
+	}
+	sigs, sigsChanged := h.signals()
+	own := nil == forkCh
+	var ownCh chan os.Signal
+	listen := func() {
+		if nil != ownCh {
+			signal.Stop(ownCh)
+			ownCh = nil
+		}
+		if forkCh = earlyForkCh(sigs.fork); nil != forkCh {
+			return
+		}
+		ownCh = h.signalCh()
+		signal.Notify(ownCh, sigs.fork)
+		forkCh = ownCh
+	}
+	if own {
+		listen()
+		defer func() {
+			if nil != ownCh {
+				signal.Stop(ownCh)
+			}
+		}()
+	}
 
 	logln("Waiting for fork signal from system...")
+	waitStart := time.Now()
+
+	// Only one restart at a time: a Wait in another goroutine that's
+	// already mid-restart leaves this one waiting for the next signal, or
+	// with QueueRestarts queues one.  A restart CanRestart defers stays
+	// pending and is re-checked every DeferInterval, so it goes ahead once
+	// the predicate clears without needing another fork signal; more fork
+	// signals meanwhile just trigger an early re-check.
+	var trigger os.Signal
+	deferred, queued := false, false
+	for {
+		var recheckCh <-chan time.Time
+		if deferred {
+			recheckCh = time.After(h.cfg.DeferInterval)
+		}
+		if queued {
+			queued = false
+		} else {
+			select {
+			case trigger = <-forkCh:
+			case <-recheckCh:
+			case <-sigsChanged:
+				old := sigs.fork
+				sigs, sigsChanged = h.signals()
+				if own && sigs.fork != old {
+					logln("Fork signal changed from", old, "to", sigs.fork)
+					listen()
+				}
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if up := time.Since(processStart); up < h.cfg.MinUptime {
+			logln("Refusing to restart after only", up.Round(time.Millisecond), "of uptime.")
+			return fmt.Errorf("%w: up %v of %v", ErrRestartTooSoon, up.Round(time.Millisecond), h.cfg.MinUptime)
+		}
+		if nil != h.cfg.CanRestart && !h.cfg.CanRestart() {
+			if !deferred {
+				logln("Restart deferred.")
+			}
+			deferred = true
+			continue
+		}
+		deferred = false
+		if !h.restarting.CompareAndSwap(false, true) {
+			if h.cfg.QueueRestarts {
+				logln("Restart already in progress, queueing another.")
+				h.queued.Store(true)
+			} else {
+				logln("Restart already in progress, ignoring fork signal.")
+			}
+			continue
+		}
+		t.sigs, _ = h.signals()
+		var stop func() bool
+		if h.cfg.QueueRestarts {
+			stop = h.queueForks(forkCh)
+		}
+		err := h.restartOnce(ctx, t, trigger, waitStart, quitCh)
+		if nil == stop || !stop() {
+			return err
+		}
+		if nil == err {
+			h.passQueued(t.sigs.fork)
+			return nil
+		}
+		logln("Restart failed, running the queued one:", err)
+		queued, waitStart = true, time.Now()
+	}
+}
 
-	<-forkCh
+// Run one restart triggered by trigger, holding the right to restart until
+// it's over.
+func (h *Handler) restartOnce(ctx context.Context, t handoff, trigger os.Signal, waitStart time.Time, quitCh <-chan os.Signal) error {
+	if _, ok := trigger.(binaryChanged); ok {
+		trigger = nil
+	}
+	h.beginResult(RestartResult{
+		OldPid: os.Getpid(),
+		Start:  time.Now(),
+		Signal: trigger,
+		Timing: RestartTiming{WaitForSignal: time.Since(waitStart)},
+	})
+	atomic.AddInt32(&restarting, 1)
+	defer func() {
+		atomic.AddInt32(&restarting, -1)
+		h.restarting.Store(false)
+	}()
+	return h.restart(ctx, t, quitCh)
+}
 
-	cp, err := forkExec(l, quitSignal)
-	if err != nil {
-		logln(err)
+// Carry out one restart after the fork signal, reporting each phase to
+// Config.OnPhase.  The quit signal comes from quitCh if it isn't nil.
+func (h *Handler) restart(ctx context.Context, t handoff, quitCh <-chan os.Signal) (err error) {
+	opts := h.cfg.ForkOptions
+	if 0 < h.cfg.Deadline {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.cfg.Deadline)
+		defer cancel()
+	}
+
+	// Listen for the child's signals before it exists so a quick child
+	// can't signal before there's a handler.  A quit signal the caller's
+	// channel already holds can't be from this child.
+	if nil == quitCh {
+		ch := h.signalCh()
+		signal.Notify(ch, t.sigs.confirm())
+		defer signal.Stop(ch)
+		quitCh = ch
+	} else {
+		drainSignals(quitCh)
+	}
+
+	// A nil channel never receives so this case is inert without AbortSignal.
+	var abortCh <-chan os.Signal
+	if 0 != t.sigs.abort {
+		ch := h.signalCh()
+		signal.Notify(ch, t.sigs.abort)
+		defer signal.Stop(ch)
+		abortCh = ch
+	}
 
-		if cp != nil {
-			kErr := cp.Kill()
-			if kErr != nil {
-				logln("Unable to kill process after bad forkExec", kErr)
+	var (
+		cp     *os.Process
+		exited <-chan struct{}
+		pid    int
+	)
+	forkStart := time.Now()
+	defer func() {
+		closeTransferred()
+		h.recordResult(func(r *RestartResult) {
+			r.NewPid, r.Outcome, r.Err = pid, outcomeOf(err), err
+		})
+		h.archiveResult()
+		if nil != err {
+			return
+		}
+		keepUnixSockets(t.ls)
+		if 0 < h.cfg.ExitWatchdog {
+			armExitWatchdog(h.cfg.ExitWatchdog)
+		}
+		if nil != h.cfg.OnParentExit {
+			runBounded(h.cfg.OnParentExit, h.cfg.ParentExitTimeout)
+		}
+	}()
+	return h.phase(PhaseRestart, &pid, func() error {
+		for attempt := 0; ; attempt++ {
+			var err error
+			cp, exited, err = h.spawn(ctx, t, quitCh, abortCh, &pid)
+			if nil == err {
+				break
+			}
+			retryable := errors.Is(err, ErrRestartAborted) || errors.Is(err, ErrChildDied)
+			if !retryable || attempt >= h.cfg.ForkRetries {
+				return err
+			}
+			backoff := h.cfg.RetryBackoff << attempt
+			logln("Retrying restart in", backoff, "attempt", attempt+2, "of", h.cfg.ForkRetries+1)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return fmt.Errorf("restart abandoned: %w", ctx.Err())
 			}
+			drainSignals(quitCh)
 		}
+		readyAt := time.Now()
+		h.recordTiming(func(rt *RestartTiming) {
+			rt.ForkToReady = readyAt.Sub(forkStart)
+		})
+		defer h.recordTiming(func(rt *RestartTiming) {
+			rt.Handoff = time.Since(readyAt)
+		})
+		if nil != h.cfg.Verify {
+			if err := h.phase(PhaseVerify, &pid, func() error {
+				return h.verify(cp)
+			}); nil != err {
+				return err
+			}
+		}
+		if nil != h.cfg.CompatCheck {
+			if err := h.phase(PhaseCompat, &pid, func() error {
+				return h.compatCheck(cp, t)
+			}); nil != err {
+				return err
+			}
+		}
+		if nil != h.cfg.ExternalReady {
+			if err := h.phase(PhaseExternal, &pid, func() error {
+				return h.awaitExternalReady(ctx, cp, exited)
+			}); nil != err {
+				return err
+			}
+		}
+		if 0 != opts.CutoverSignal {
+			if err := cutover(t.ls, cp, opts.CutoverSignal); nil != err {
+				return err
+			}
+		}
+		if nil != h.cfg.OnHandoff {
+			h.cfg.OnHandoff(cp.Pid)
+		}
+		if opts.StandbyDuration > 0 {
+			return h.phase(PhaseStandby, &pid, func() error {
+				return standby(t.ls, cp, exited, opts.StandbyDuration)
+			})
+		}
+		return nil
+	})
+}
 
-		return err
+// Fork a child and wait for it to be ready: one attempt at a restart.  pid is
+// filled in as soon as there's a child.  The channel is closed once the
+// child exits; nothing else may Wait for it.
+func (h *Handler) spawn(ctx context.Context, t handoff, quitCh, abortCh <-chan os.Signal, pid *int) (cp *os.Process, exited <-chan struct{}, err error) {
+	if h.cfg.SharedMemory {
+		shm, err := newSharedState()
+		if nil != err {
+			return nil, nil, fmt.Errorf("%w: %w", ErrSetEnv, err)
+		}
+		defer shm.close()
+		t.shm = shm
+		watchCtx, stop := context.WithCancel(ctx)
+		defer stop()
+		quitCh, abortCh = shm.watch(watchCtx, t.sigs.confirm())
+	}
+	if (0 == len(t.ls) && nil == t.raw) || nil != h.cfg.CompatCheck {
+		report, err := newAddrReport()
+		if nil != err {
+			return nil, nil, fmt.Errorf("%w: %w", ErrSetEnv, err)
+		}
+		defer report.close()
+		t.report = report
+	}
+	var info *ExecInfo
+	if err = h.phase(PhaseFork, pid, func() (err error) {
+		cp, info, err = h.fork(t)
+		if nil != cp {
+			*pid = cp.Pid
+		}
+		return
+	}, func(ev *PhaseEvent) { ev.Exec = info }); nil != err {
+		return
+	}
+	exited = reap(cp)
+	err = h.phase(PhaseReady, pid, func() error {
+		return h.awaitReady(ctx, cp, exited, quitCh, abortCh)
+	})
+	if nil == err && nil != t.report {
+		if a := t.report.read(); nil != a {
+			logln("child", cp.Pid, "bound", a)
+			h.recordResult(func(r *RestartResult) {
+				r.ChildAddr = a
+			})
+		}
+	}
+	return
+}
+
+// Wait for cp in the background, closing the channel once it has exited.
+func reap(cp *os.Process) <-chan struct{} {
+	exited := make(chan struct{})
+	go func() {
+		state, err := cp.Wait()
+		if nil == err {
+			childExited(cp.Pid, state)
+		}
+		close(exited)
+	}()
+	return exited
+}
+
+// Run f, giving up on it after timeout unless that's zero.
+func runBounded(f func(), timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+	select {
+	case <-done:
+	case <-after(timeout):
+		logln("Abandoning OnParentExit after", timeout)
+	}
+}
+
+// Resolve KillChildOnSetupError's default.
+func (o ForkOptions) killChildOnSetupError() bool {
+	return nil == o.KillChildOnSetupError || *o.KillChildOnSetupError
+}
+
+// Exit the process if it's still running after d.
+func armExitWatchdog(d time.Duration) {
+	time.AfterFunc(d, func() {
+		logln("WATCHDOG: still running", d, "after handing off, exiting; shutdown is stuck")
+		os.Exit(1)
+	})
+}
+
+// Fork and exec the child, killing it if it started but setup then failed
+// unless ForkOptions.KillChildOnSetupError says to leave it.
+func (h *Handler) fork(t handoff) (*os.Process, *ExecInfo, error) {
+	opts := h.cfg.ForkOptions
+	opts.ReadySignal, opts.AbortSignal = t.sigs.ready, t.sigs.abort
+	if h.cfg.QueueRestarts {
+		opts.queueSignal = t.sigs.fork
+	}
+	cp, info, err := forkExec(t, t.sigs.quit, opts)
+	if err != nil {
+		logln(err)
+		if nil == cp {
+			return nil, info, err
+		}
+		reap(cp)
+		if !opts.killChildOnSetupError() {
+			logln("Leaving child", cp.Pid, "running after bad forkExec")
+			return cp, info, err
+		}
+		kErr := cp.Kill()
+		if kErr != nil {
+			logln("Unable to kill process after bad forkExec", kErr)
+		}
+		return nil, info, err
+	}
+	if nil != h.cfg.OnFork {
+		h.cfg.OnFork(cp.Pid)
 	}
+	return cp, info, nil
+}
 
+// Wait for the child to send the quit signal, killing it if it aborts, takes
+// too long or ctx is done first.  A child that exits first has failed
+// outright, however much time it had left.  With a WarmupTimeout longer than
+// Timeout a live child gets the extra time, on the assumption it's warming
+// up rather than broken.
+func (h *Handler) awaitReady(ctx context.Context, cp *os.Process, exited <-chan struct{}, quitCh, abortCh <-chan os.Signal) error {
 	logln("Waiting for quit signal from child...")
 
-	quitCh := make(chan os.Signal, 1)
-	signal.Notify(quitCh, quitSignal)
+	timeout := h.cfg.Timeout
+	if 0 != timeout && h.cfg.WarmupTimeout > timeout {
+		warming := time.AfterFunc(timeout, func() {
+			logln("Child", cp.Pid, "is still warming up, waiting up to", h.cfg.WarmupTimeout)
+		})
+		defer warming.Stop()
+		timeout = h.cfg.WarmupTimeout
+	}
 
 	select {
+	case <-exited:
+		select {
+		case <-quitCh:
+			logln("Received quit signal from child.")
+			return nil
+		default:
+		}
+		logln("Child", cp.Pid, "exited before it was ready.")
+		return ErrChildDied
 	case <-quitCh:
+
+		// select picks at random among ready cases, so give an abort that
+		// arrived alongside the quit signal the last word.
+		select {
+		case <-abortCh:
+			return h.abort(cp)
+		default:
+		}
 		logln("Received quit signal from child.")
-	case <-time.After(timeout):
-		msg := "Timed out waiting for child to send signal"
-		logln(msg)
-		err = cp.Kill()
-		if err != nil {
-			logln("Unable to kill process after timeout", err)
+	case <-abortCh:
+		return h.abort(cp)
+	case <-after(timeout):
+		err := fmt.Errorf(
+			"%w: child %d sent no signal within %v",
+			ErrReadyTimeout,
+			cp.Pid,
+			timeout,
+		)
+		logln(err)
+		if kErr := cp.Kill(); kErr != nil {
+			logln("Unable to kill process after timeout", kErr)
 		}
-		return fmt.Errorf(msg)
+		return err
+	case <-ctx.Done():
+		logln("Restart abandoned:", ctx.Err())
+		if err := cp.Kill(); nil != err {
+			logln("Unable to kill process after deadline", err)
+		}
+		return fmt.Errorf("restart abandoned: %w", ctx.Err())
 	}
+	return nil
+}
+
+// Kill a child that sent the abort signal.
+func (h *Handler) abort(cp *os.Process) error {
+	logln("Child", cp.Pid, "aborted the restart.")
+	if err := cp.Kill(); nil != err {
+		logln("Unable to kill process after abort", err)
+	}
+	return ErrRestartAborted
+}
 
+// Run Config.Verify, killing the child if it fails.
+func (h *Handler) verify(cp *os.Process) error {
+	if err := h.cfg.Verify(); nil != err {
+		logln("Child", cp.Pid, "failed verification:", err)
+		if kErr := cp.Kill(); nil != kErr {
+			logln("Unable to kill process after failed verification", kErr)
+		}
+		return fmt.Errorf("%w: %w", ErrVerifyFailed, err)
+	}
 	return nil
 }
 
+// The address to probe the child at: the one it reported or, failing that,
+// the one it shares with us.
+func (h *Handler) childAddr(t handoff) string {
+	if a := h.LastResult().ChildAddr; nil != a {
+		return a.String()
+	}
+	if 0 < len(t.ls) {
+		return t.ls[0].Addr().String()
+	}
+	return t.addr
+}
+
+func (h *Handler) compatCheck(cp *os.Process, t handoff) error {
+	addr := h.childAddr(t)
+	if err := h.cfg.CompatCheck(addr); nil != err {
+		logln("Child", cp.Pid, "at", addr, "failed the compatibility check:", err)
+		if kErr := cp.Kill(); nil != kErr {
+			logln("Unable to kill process after failed compatibility check", kErr)
+		}
+		return fmt.Errorf("%w: %w", ErrIncompatible, err)
+	}
+	return nil
+}
+
+// Like time.After but a zero duration never fires.
+func after(d time.Duration) <-chan time.Time {
+	if 0 == d {
+		return nil
+	}
+	return time.After(d)
+}
+
+// Stop accepting on ls and watch the child for d, resuming if it dies.
+func standby(ls []net.Listener, cp *os.Process, exited <-chan struct{}, d time.Duration) error {
+	if err := setDeadlines(ls, time.Now()); nil != err {
+		return err
+	}
+	logln("Standing by for", d, "while child", cp.Pid, "serves...")
+
+	select {
+	case <-exited:
+		logln("Child", cp.Pid, "exited during standby; resuming.")
+		if err := setDeadlines(ls, time.Time{}); nil != err {
+			return err
+		}
+		for _, l := range ls {
+			if err := resumeAccepting(l); nil != err {
+				return err
+			}
+		}
+		return ErrChildExited
+	case <-time.After(d):
+	}
+	return nil
+}
+
+// Undo StopAccepting on every GracefulListener among l and the listeners
+// it wraps, which OnHandoff may have stopped before standby.
+func resumeAccepting(l net.Listener) error {
+	for {
+		if gl, ok := l.(*GracefulListener); ok {
+			if err := gl.ResumeAccepting(); nil != err {
+				return err
+			}
+		}
+		u, ok := l.(interface {
+			Unwrap() net.Listener
+		})
+		if !ok {
+			return nil
+		}
+		next := u.Unwrap()
+		if nil == next || next == l {
+			return nil
+		}
+		l = next
+	}
+}
+
+// Stop Close from unlinking the path of any Unix socket in ls, as it does
+// for one we bound ourselves, now that the child is serving on it.
+func keepUnixSockets(ls []net.Listener) {
+	for _, l := range ls {
+		if ul, ok := unwrap(l).(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+}
+
+// What StopAccepting, standby and cutover stop Accept with.  Every TCP and
+// Unix listener has it; one on a RegisterNetwork transport may not.
+type deadliner interface {
+	SetDeadline(time.Time) error
+}
+
+// Refuse up front listeners that StandbyDuration or CutoverSignal would
+// have no way to stop, rather than once the child has taken over.
+func (o ForkOptions) checkStoppable(ls []net.Listener) error {
+	if 0 == o.StandbyDuration && 0 == o.CutoverSignal {
+		return nil
+	}
+	for _, l := range ls {
+		if _, ok := unwrap(l).(deadliner); !ok {
+			return fmt.Errorf("StandbyDuration and CutoverSignal need a listener with SetDeadline, not %T", unwrap(l))
+		}
+	}
+	return nil
+}
+
+func setDeadlines(ls []net.Listener, t time.Time) error {
+	for _, l := range ls {
+		dl, ok := unwrap(l).(deadliner)
+		if !ok {
+			return fmt.Errorf("%T has no SetDeadline to stop accepting with", unwrap(l))
+		}
+		if err := dl.SetDeadline(t); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decide where the child starts.  A pinned Dir is used as is; otherwise fall
+// back from a vanished working directory rather than failing the restart.
+func childDir(opts ForkOptions, argv0 string) string {
+	if "" != opts.Dir {
+		return opts.Dir
+	}
+	wd, err := os.Getwd()
+	if nil == err && isDir(wd) {
+		return wd
+	}
+	dir := filepath.Dir(argv0)
+	if !filepath.IsAbs(dir) || !isDir(dir) {
+		dir = "/"
+	}
+	logln("working directory is gone, starting child in", dir)
+	return dir
+}
+
+func isDir(path string) bool {
+	fi, err := os.Stat(path)
+	return nil == err && fi.IsDir()
+}
+
+// Decide which binary to exec and with what argv.  An explicit Argv0 replaces
+// os.Args[0] so the child sees its own name.
+func resolveArgv(opts ForkOptions) (argv0 string, argv []string, err error) {
+	if "" == opts.Argv0 && (opts.ReexecSelf || memfdLaunched()) {
+		argv0, err = runningImage()
+		return argv0, os.Args, err
+	}
+	if "" == opts.Argv0 {
+		argv0, err = LookPath()
+		return argv0, os.Args, err
+	}
+	if err = checkExecutable(opts.Argv0); nil != err {
+		return
+	}
+	argv = append([]string{opts.Argv0}, os.Args[1:]...)
+	return opts.Argv0, argv, nil
+}
+
+// Test whether path names an executable regular file.
+func checkExecutable(path string) error {
+	fi, err := os.Stat(path)
+	if nil != err {
+		return err
+	}
+	if !fi.Mode().IsRegular() || 0 == fi.Mode().Perm()&0111 {
+		return fmt.Errorf("%s is not an executable file", path)
+	}
+	return nil
+}
+
+// Find os.Args[0] afresh on every fork, never caching it, and make it
+// absolute so it still names the same file from the child's Dir.  Symlinks
+// are deliberately left for exec to follow: when /app/current is re-pointed
+// at a new release between restarts, the child runs the new release.  If
+// os.Args[0] is empty or leads nowhere, as in some sandboxes or after a
+// launch by fexecve, fall back to re-exec'ing the running binary.
 func lookPath() (argv0 string, err error) {
-	argv0, err = exec.LookPath(os.Args[0])
+	if "" != os.Args[0] {
+		argv0, err = exec.LookPath(os.Args[0])
+		if nil == err {
+			_, err = os.Stat(argv0)
+		}
+	} else {
+		err = errors.New("os.Args[0] is empty")
+	}
 	if nil != err {
-		return
+		self, sErr := selfExe()
+		if nil != sErr {
+			return "", fmt.Errorf("%w; %v", err, sErr)
+		}
+		logln("Unable to find", os.Args[0], "so re-exec'ing", self, err)
+		return self, nil
 	}
-	if _, err = os.Stat(argv0); nil != err {
-		return
+	if abs, aErr := filepath.Abs(argv0); nil == aErr {
+		argv0 = abs
 	}
 	return
 }
 
-func setEnvs(l net.Listener) (fd uintptr, err error) {
-	var f *os.File
-	switch t := l.(type) {
+// Record the environment derived from ForkOptions, applied in one pass.
+var optionEnvs = []func(ForkOptions) error{
+	setGOMAXPROCS,
+	setKeepAlive,
+	setAbortSignal,
+	setQueueSignal,
+	setCutoverSignal,
+	setReadySignal,
+}
+
+// What the child is to take over: inherited listeners or, in rebind mode, an
+// address it binds afresh.
+type handoff struct {
+	ls            []net.Listener
+	network, addr string
+
+	// The region the child reports through under Config.SharedMemory.
+	shm *sharedState
+
+	// The pipe a rebinding child reports its address through.
+	report *addrReport
+
+	// The fd to pass in place of ls under WaitRaw.
+	raw *rawFd
+
+	// The signals in force when the fork signal arrived.
+	sigs signalSet
+}
+
+// Record the handoff in the environment, returning the listeners' files to
+// pass to the child.  A lone listener is recorded as GOAGAIN_FD and
+// GOAGAIN_NAME; several also as numbered slots for Listeners, as with
+// SpawnWith.
+func (t handoff) setEnvs() ([]*os.File, error) {
+	if err := unsetenv("GOAGAIN_FD_COUNT"); nil != err {
+		return nil, err
+	}
+	if err := t.setSharedStateEnv(); nil != err {
+		return nil, err
+	}
+	if err := t.setAddrReportEnv(); nil != err {
+		return nil, err
+	}
+	if nil != t.raw {
+		return t.raw.setEnvs()
+	}
+	if 0 == len(t.ls) {
+		for _, key := range []string{"GOAGAIN_FD", "GOAGAIN_NET", "GOAGAIN_FDNAME", "GOAGAIN_INODE"} {
+			if err := unsetenv(key); nil != err {
+				return nil, err
+			}
+		}
+		if err := setRebindName(t.network, t.addr); nil != err {
+			return nil, err
+		}
+		return nil, setenv(
+			"GOAGAIN_REBIND",
+			fmt.Sprintf("%s:%s", t.network, t.addr),
+		)
+	}
+	if err := unsetenv("GOAGAIN_REBIND"); nil != err {
+		return nil, err
+	}
+	if err := checkNames(t.ls); nil != err {
+		return nil, err
+	}
+	files := make([]*os.File, 0, len(t.ls))
+	for i, l := range t.ls {
+		f, err := listenerFile(l)
+		if nil != err {
+			closeFiles(files)
+			return nil, err
+		}
+		files = append(files, f)
+		var suffixes []string
+		if 0 == i {
+			suffixes = append(suffixes, "")
+		}
+		if 1 < len(t.ls) {
+			suffixes = append(suffixes, fmt.Sprintf("_%d", i))
+		}
+		slot := newSlotEnv(f, l)
+		for _, suffix := range suffixes {
+			if err := slot.set(suffix); nil != err {
+				closeFiles(files)
+				return nil, err
+			}
+		}
+	}
+	if 1 < len(t.ls) {
+		if err := setenv(
+			"GOAGAIN_FD_COUNT",
+			fmt.Sprint(len(t.ls)),
+		); nil != err {
+			closeFiles(files)
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// The variables recorded for one passed listener, worked out once though
+// the first listener's are written under two names.  The fd number is read
+// with sysfd rather than f.Fd(), which would put the socket, l's own
+// included, in blocking mode.
+type slotEnv struct {
+	fd, name, network, inode, fdname string
+}
+
+func newSlotEnv(f *os.File, l net.Listener) slotEnv {
+	fd := sysfd(f)
+	return slotEnv{
+		fd:      fmt.Sprint(fd),
+		name:    listenerName(l),
+		network: l.Addr().Network(),
+		inode:   recordedInode(fd),
+		fdname:  ListenerName(l),
+	}
+}
+
+func (s slotEnv) set(suffix string) error {
+	for _, kv := range [...][2]string{
+		{"GOAGAIN_FD", s.fd},
+		{"GOAGAIN_NAME", s.name},
+		{"GOAGAIN_NET", s.network},
+		{"GOAGAIN_INODE", s.inode},
+		{"GOAGAIN_FDNAME", s.fdname},
+	} {
+		if err := updateEnv(kv[0]+suffix, kv[1]); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+// Set key unless it already reads as value, an unset key reading as empty.
+// With cgo each setenv goes through libc, which rescans the whole
+// environment, and across restarts most slot variables come out the same,
+// while GOAGAIN_FDNAME and, off Linux, GOAGAIN_INODE are usually empty.
+func updateEnv(key, value string) error {
+	if v, ok := os.LookupEnv(key); v == value && (ok || "" == value) {
+		return nil
+	}
+	return setenv(key, value)
+}
+
+// Dup the socket behind l into a file to pass to a child.
+func listenerFile(l net.Listener) (*os.File, error) {
+	switch t := unwrap(l).(type) {
 	case *net.TCPListener:
-		f, err = t.File()
+		return aboveStdio(t.File())
 	case *net.UnixListener:
-		f, err = t.File()
-	default:
-		return fd, fmt.Errorf("setEnvs: file descriptor is %T not *net.TCPListener or *net.UnixListener", l)
+		return aboveStdio(t.File())
 	}
-	if err != nil {
-		return
+	if f, ok, err := customListenerFile(unwrap(l)); ok {
+		return f, err
 	}
-	fd = f.Fd()
-	if err = os.Setenv("GOAGAIN_FD", fmt.Sprint(fd)); nil != err {
-		return
+	return nil, fmt.Errorf("setEnvs: file descriptor is %T not *net.TCPListener or *net.UnixListener", l)
+}
+
+// Move f to an fd of 3 or more if it's landed on 0, 1 or 2, as dup does once
+// a daemon has closed its stdio.  Each file is passed at its own fd number,
+// so one there would collide with the child's stdio.
+func aboveStdio(f *os.File, err error) (*os.File, error) {
+	if nil != err || sysfd(f) > uintptr(syscall.Stderr) {
+		return f, err
+	}
+	defer f.Close()
+	fd, _, errno := syscall.Syscall(syscall.SYS_FCNTL, sysfd(f), syscall.F_DUPFD, uintptr(syscall.Stderr+1))
+	if 0 != errno {
+		return nil, fmt.Errorf("moving fd %d above stdio: %w", sysfd(f), errno)
 	}
+	syscall.CloseOnExec(int(fd))
+	return os.NewFile(fd, f.Name()), nil
+}
+
+// The name recorded alongside a passed listener's fd.
+func listenerName(l net.Listener) string {
 	addr := l.Addr()
-	if err = os.Setenv(
-		"GOAGAIN_NAME",
-		fmt.Sprintf("%s:%s->", addr.Network(), addr.String()),
-	); nil != err {
+	return fmt.Sprintf("%s:%s->", addr.Network(), addr.String())
+}
+
+// Record the GOMAXPROCS the child should use, or clear any value we inherited
+// ourselves if pinning isn't wanted.
+func setGOMAXPROCS(opts ForkOptions) error {
+	if !opts.GOMAXPROCS {
+		return unsetenv("GOAGAIN_GOMAXPROCS")
+	}
+	return setenv("GOAGAIN_GOMAXPROCS", fmt.Sprint(runtime.GOMAXPROCS(0)))
+}
+
+// Apply the GOMAXPROCS pinned by our parent, if any.  A bad value is logged
+// and otherwise ignored since the runtime's own choice is a safe fallback.
+func inheritGOMAXPROCS() {
+	s := os.Getenv("GOAGAIN_GOMAXPROCS")
+	if "" == s {
 		return
 	}
-	return
+	var n int
+	if _, err := fmt.Sscan(s, &n); nil != err || n < 1 {
+		logln("ignoring bad GOAGAIN_GOMAXPROCS", s)
+		return
+	}
+	runtime.GOMAXPROCS(n)
+}
+
+func setAbortSignal(opts ForkOptions) error {
+	if 0 == opts.AbortSignal {
+		return unsetenv("GOAGAIN_ABORT_SIGNAL")
+	}
+	return setenv("GOAGAIN_ABORT_SIGNAL", fmt.Sprint(int(opts.AbortSignal)))
 }
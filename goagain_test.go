@@ -0,0 +1,761 @@
+package goagain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// The test binary doubles as the stand-in child, behaving as STANDIN_CHILD
+// says: "sleep" until killed, "exit" straight away or "accept" one
+// connection on the listener it inherited.
+func TestMain(m *testing.M) {
+	switch os.Getenv("STANDIN_CHILD") {
+	case "sleep":
+		time.Sleep(time.Minute)
+		os.Exit(0)
+	case "exit":
+		os.Exit(3)
+	case "accept":
+		os.Exit(acceptOnce())
+	}
+	os.Exit(m.Run())
+}
+
+// Inherit the listener, as a real child would, accept one connection and
+// send "ok" down it.
+func acceptOnce() int {
+	l, err := Listener()
+	if nil != err {
+		fmt.Fprintln(os.Stderr, "Listener:", err)
+		return 1
+	}
+	c, err := l.Accept()
+	if nil != err {
+		fmt.Fprintln(os.Stderr, "Accept:", err)
+		return 1
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("ok")); nil != err {
+		fmt.Fprintln(os.Stderr, "Write:", err)
+		return 1
+	}
+	return 0
+}
+
+// Dial addr on network and read what the child that accepts it sends.
+func childSays(t *testing.T, network, addr string) string {
+	t.Helper()
+	c, err := net.Dial(network, addr)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := io.ReadAll(c)
+	if nil != err {
+		t.Errorf("reading from the child: %v", err)
+	}
+	return string(b)
+}
+
+// Put the GOAGAIN_ environment back as it was once t is done, since forking
+// rewrites it.
+func keepEnv(t *testing.T) {
+	snap := snapshotEnv()
+	t.Cleanup(func() { restoreEnv(snap) })
+}
+
+// The test binary, found before any test changes os.Args or the working
+// directory.
+var testBinary = func() string {
+	if exe, err := os.Executable(); nil == err {
+		return exe
+	}
+	return os.Args[0]
+}()
+
+// What one fork was asked to start: the binary and the attributes.
+type forkStart struct {
+	argv0 string
+	*os.ProcAttr
+}
+
+// Stand in for the fork with a copy of the test binary behaving as child
+// says, then, unless sig is zero, send ourselves sig as a real child would
+// once it had taken over.  No goagain child is exec'd.  The returned slice
+// collects what each fork was asked to start the child with.
+func standIn(t *testing.T, child string, sig syscall.Signal) *[]forkStart {
+	var starts []forkStart
+	start := startProcess
+	t.Cleanup(func() { startProcess = start })
+	startProcess = func(argv0 string, argv []string, attr *os.ProcAttr) (*os.Process, error) {
+		starts = append(starts, forkStart{argv0, attr})
+		a := *attr
+		a.Env = append(append([]string(nil), attr.Env...), "STANDIN_CHILD="+child)
+		p, err := os.StartProcess(testBinary, []string{testBinary}, &a)
+		if nil == err && 0 != sig {
+			syscall.Kill(os.Getpid(), sig)
+		}
+		return p, err
+	}
+	return &starts
+}
+
+// Pass ls to a stand-in child that exits straight away, putting them
+// through everything a restart does to them, File and Fd included.
+func forkOnce(t *testing.T, ls ...net.Listener) {
+	keepEnv(t)
+	standIn(t, "exit", 0)
+	p, _, err := forkExec(handoff{ls: ls}, syscall.SIGQUIT, ForkOptions{})
+	if nil != err {
+		t.Fatal(err)
+	}
+	p.Wait()
+}
+
+func listenTCP(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func listenUnix(t *testing.T) net.Listener {
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "sock"))
+	if nil != err {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+// A listener with no socket underneath, handing out one end of a net.Pipe
+// per Accept.
+type memListener struct{ conns chan net.Conn }
+
+func (l memListener) Accept() (net.Conn, error) {
+	c, ok := <-l.conns
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return c, nil
+}
+
+func (l memListener) Close() error   { return nil }
+func (l memListener) Addr() net.Addr { return memAddr("mem") }
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+// Wait up to a few seconds for pid to be gone.
+func waitGone(t *testing.T, pid int) {
+	for i := 0; i < 300; i++ {
+		if syscall.ESRCH == syscall.Kill(pid, 0) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("child %d still running", pid)
+}
+
+func TestRestartHandshake(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		cfg     Config
+		child   string
+		send    syscall.Signal
+		want    error
+		outcome Outcome
+	}{{
+		name:    "quit signal",
+		cfg:     Config{Timeout: 5 * time.Second},
+		child:   "sleep",
+		send:    syscall.SIGQUIT,
+		outcome: OutcomeSucceeded,
+	}, {
+		name:    "remapped quit signal",
+		cfg:     Config{QuitSignal: syscall.SIGUSR2, Timeout: 5 * time.Second},
+		child:   "sleep",
+		send:    syscall.SIGUSR2,
+		outcome: OutcomeSucceeded,
+	}, {
+		name: "ready signal",
+		cfg: Config{
+			Timeout:     5 * time.Second,
+			ForkOptions: ForkOptions{ReadySignal: syscall.SIGUSR1},
+		},
+		child:   "sleep",
+		send:    syscall.SIGUSR1,
+		outcome: OutcomeSucceeded,
+	}, {
+		name:    "quit timeout",
+		cfg:     Config{Timeout: 100 * time.Millisecond},
+		child:   "sleep",
+		want:    ErrReadyTimeout,
+		outcome: OutcomeTimedOut,
+	}, {
+		name: "abort signal",
+		cfg: Config{
+			Timeout:     5 * time.Second,
+			ForkOptions: ForkOptions{AbortSignal: syscall.SIGUSR2},
+		},
+		child:   "sleep",
+		send:    syscall.SIGUSR2,
+		want:    ErrRestartAborted,
+		outcome: OutcomeAborted,
+	}, {
+		name:    "not ready",
+		cfg:     Config{Timeout: 5 * time.Second},
+		child:   "exit",
+		want:    ErrChildDied,
+		outcome: OutcomeChildDied,
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			keepEnv(t)
+			standIn(t, tt.child, tt.send)
+			h := NewWithConfig(tt.cfg)
+			th := handoff{ls: []net.Listener{listenTCP(t)}}
+			th.sigs, _ = h.signals()
+			h.beginResult(RestartResult{OldPid: os.Getpid()})
+
+			err := h.restart(context.Background(), th, nil)
+			res := h.LastResult()
+			if 0 != res.NewPid {
+				defer waitGone(t, res.NewPid)
+				if nil == err {
+					defer syscall.Kill(res.NewPid, syscall.SIGKILL)
+				}
+			}
+			if !errors.Is(err, tt.want) || (nil == tt.want) != (nil == err) {
+				t.Fatalf("restart: %v, want %v", err, tt.want)
+			}
+			if tt.outcome != res.Outcome {
+				t.Errorf("outcome %s, want %s", res.Outcome, tt.outcome)
+			}
+			if 0 == res.NewPid {
+				t.Error("no child pid recorded")
+			}
+		})
+	}
+}
+
+// The fork signal, caught early by Init, starts a restart from Wait.
+func TestWaitForkSignal(t *testing.T) {
+	keepEnv(t)
+	standIn(t, "sleep", syscall.SIGQUIT)
+	h := NewWithConfig(Config{ForkSignal: syscall.SIGUSR1, Timeout: 5 * time.Second})
+	h.Init()
+	defer Cleanup()
+	syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+
+	res, err := h.WaitResult(listenTCP(t))
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer waitGone(t, res.NewPid)
+	defer syscall.Kill(res.NewPid, syscall.SIGKILL)
+	if syscall.SIGUSR1 != res.Signal {
+		t.Errorf("triggered by %v, want %v", res.Signal, syscall.SIGUSR1)
+	}
+}
+
+// The fd extraction and environment writes a restart does for n listeners.
+// Cold, each iteration starts from an environment without the slots, as on
+// the first restart; warm, the last iteration's values are still there, as
+// on a retry.
+func benchmarkSetEnvs(b *testing.B, n int, cold bool) {
+	snap := snapshotEnv()
+	defer restoreEnv(snap)
+	th := handoff{}
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if nil != err {
+			b.Fatal(err)
+		}
+		defer l.Close()
+		th.ls = append(th.ls, l)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if cold {
+			b.StopTimer()
+			restoreEnv(snap)
+			b.StartTimer()
+		}
+		files, err := th.setEnvs()
+		if nil != err {
+			b.Fatal(err)
+		}
+		closeFiles(files)
+	}
+}
+
+func BenchmarkSetEnvsCold1(b *testing.B)  { benchmarkSetEnvs(b, 1, true) }
+func BenchmarkSetEnvsCold16(b *testing.B) { benchmarkSetEnvs(b, 16, true) }
+func BenchmarkSetEnvsCold64(b *testing.B) { benchmarkSetEnvs(b, 64, true) }
+func BenchmarkSetEnvsWarm1(b *testing.B)  { benchmarkSetEnvs(b, 1, false) }
+func BenchmarkSetEnvsWarm16(b *testing.B) { benchmarkSetEnvs(b, 16, false) }
+func BenchmarkSetEnvsWarm64(b *testing.B) { benchmarkSetEnvs(b, 64, false) }
+
+// Fail setenv for key, as if the environment had run out of room, unless
+// it's clearing key.
+func failSetenv(t *testing.T, key string) {
+	set := setenv
+	t.Cleanup(func() { setenv = set })
+	setenv = func(k, v string) error {
+		if key == k && "" != v {
+			return syscall.ENOMEM
+		}
+		return set(k, v)
+	}
+}
+
+// A child started before setup failed is killed unless the caller asks to
+// keep it.
+func TestKillChildOnSetupError(t *testing.T) {
+	no := false
+	for _, tt := range []struct {
+		name string
+		kill *bool
+		want bool
+	}{
+		{"default", nil, true},
+		{"kept", &no, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			keepEnv(t)
+			starts := standIn(t, "sleep", 0)
+			failSetenv(t, "GOAGAIN_PID")
+			h := NewWithConfig(Config{
+				ForkOptions: ForkOptions{KillChildOnSetupError: tt.kill},
+			})
+			th := handoff{ls: []net.Listener{listenTCP(t)}}
+			th.sigs, _ = h.signals()
+
+			cp, _, err := h.fork(th)
+			if !errors.Is(err, ErrSetEnv) {
+				t.Fatalf("fork: %v, want %v", err, ErrSetEnv)
+			}
+			if 1 != len(*starts) {
+				t.Fatalf("%d children started, want 1", len(*starts))
+			}
+			if tt.want {
+				if nil != cp {
+					t.Errorf("child %d returned after being killed", cp.Pid)
+				}
+				return
+			}
+			if nil == cp {
+				t.Fatal("kept child not returned")
+			}
+			defer waitGone(t, cp.Pid)
+			defer cp.Kill()
+			if err := syscall.Kill(cp.Pid, 0); nil != err {
+				t.Errorf("kept child %d: %v", cp.Pid, err)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tcp := listenTCP(t)
+	mem := memListener{}
+	for _, tt := range []struct {
+		name string
+		l    net.Listener
+		ok   bool
+	}{
+		{"tcp", tcp, true},
+		{"unix", listenUnix(t), true},
+		{"wrapped tcp", wrappedListener{wrappedListener{tcp}}, true},
+		{"graceful tcp", NewGracefulListener(tcp), true},
+		{"in-memory", mem, false},
+		{"wrapped in-memory", wrappedListener{mem}, false},
+	} {
+		if err := Validate(tt.l); tt.ok != (nil == err) {
+			t.Errorf("%s: Validate = %v", tt.name, err)
+		}
+	}
+}
+
+// The error Accept on l returns once stop has been applied to it.
+func acceptErr(t *testing.T, l net.Listener, stop func(net.Listener)) error {
+	stop(l)
+	c, err := l.Accept()
+	if nil == err {
+		c.Close()
+		t.Fatalf("Accept on %s succeeded", l.Addr().Network())
+	}
+	return err
+}
+
+func closeListener(l net.Listener) { l.Close() }
+
+func expireListener(l net.Listener) {
+	l.(interface{ SetDeadline(time.Time) error }).SetDeadline(time.Now())
+}
+
+func TestIsErrClosing(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"closed tcp", acceptErr(t, listenTCP(t), closeListener), true},
+		{"closed unix", acceptErr(t, listenUnix(t), closeListener), true},
+		{"expired tcp", acceptErr(t, listenTCP(t), expireListener), true},
+		{"expired unix", acceptErr(t, listenUnix(t), expireListener), true},
+		{"wrapped", fmt.Errorf("serve: %w", net.ErrClosed), true},
+		{"other accept error", &net.OpError{Op: "accept", Err: syscall.EMFILE}, false},
+		{"server closed", errors.New(errServerClosed), false},
+		{"nil", nil, false},
+	} {
+		if got := IsErrClosing(tt.err); tt.want != got {
+			t.Errorf("%s: IsErrClosing(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+// The parent's listener keeps accepting from the fork until the child says
+// it's ready.
+func TestParentAcceptsUntilReady(t *testing.T) {
+	keepEnv(t)
+	standIn(t, "sleep", 0)
+	started := make(chan *os.Process, 1)
+	start := startProcess
+	startProcess = func(argv0 string, argv []string, attr *os.ProcAttr) (*os.Process, error) {
+		p, err := start(argv0, argv, attr)
+		if nil == err {
+			started <- p
+		}
+		return p, err
+	}
+	h := NewWithConfig(Config{Timeout: 5 * time.Second})
+	l := listenTCP(t)
+	th := handoff{ls: []net.Listener{l}}
+	th.sigs, _ = h.signals()
+	errCh := make(chan error, 1)
+	go func() { errCh <- h.restart(context.Background(), th, nil) }()
+
+	var cp *os.Process
+	select {
+	case cp = <-started:
+	case err := <-errCh:
+		t.Fatalf("restart returned before the child started: %v", err)
+	}
+	defer waitGone(t, cp.Pid)
+	defer cp.Kill()
+	for i := 0; i < 3; i++ {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if nil != err {
+			t.Fatal(err)
+		}
+		c.Close()
+		s, err := l.Accept()
+		if nil != err {
+			t.Fatalf("Accept while the child warms up: %v", err)
+		}
+		s.Close()
+	}
+	select {
+	case err := <-errCh:
+		t.Fatalf("restart returned before the child was ready: %v", err)
+	default:
+	}
+	syscall.Kill(os.Getpid(), syscall.SIGQUIT)
+	if err := <-errCh; nil != err {
+		t.Fatal(err)
+	}
+}
+
+func TestIsEphemeral(t *testing.T) {
+	for _, tt := range []struct {
+		network, addr string
+		want          bool
+	}{
+		{"tcp", ":0", true},
+		{"tcp4", "127.0.0.1:0", true},
+		{"tcp6", "[::1]:", true},
+		{"tcp", ":8080", false},
+		{"tcp", "localhost:http", false},
+		{"unix", "/tmp/sock:0", false},
+		{"tcp", "no port", false},
+	} {
+		if got := isEphemeral(tt.network, tt.addr); tt.want != got {
+			t.Errorf("isEphemeral(%q, %q) = %v, want %v", tt.network, tt.addr, got, tt.want)
+		}
+	}
+}
+
+// Rebinding port 0 would land the child on some other port, so it's refused
+// before waiting for the fork signal.
+func TestWaitRebindEphemeral(t *testing.T) {
+	err := NewWithConfig(Config{}).WaitRebind("tcp", "127.0.0.1:0")
+	if !errors.Is(err, ErrEphemeralRebind) {
+		t.Errorf("WaitRebind: %v, want %v", err, ErrEphemeralRebind)
+	}
+}
+
+// A listener bound to port 0 is passed with the port the OS assigned.
+func TestEphemeralPortInherited(t *testing.T) {
+	l := listenTCP(t)
+	addr := l.Addr().String()
+	passToSelf(t, l)
+	inherited, err := Listener()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer inherited.Close()
+	if got := inherited.Addr().String(); addr != got {
+		t.Errorf("inherited listener on %s, want %s", got, addr)
+	}
+}
+
+// Restart after restart, failed or not, leaves no listener dups behind in
+// the parent.
+func TestRestartKeepsFdsStable(t *testing.T) {
+	keepEnv(t)
+	standIn(t, "exit", 0)
+	h := NewWithConfig(Config{Timeout: 5 * time.Second})
+	th := handoff{ls: []net.Listener{listenTCP(t), listenUnix(t)}}
+	th.sigs, _ = h.signals()
+	restart := func() {
+		if err := h.restart(context.Background(), th, nil); !errors.Is(err, ErrChildDied) {
+			t.Fatalf("restart: %v, want %v", err, ErrChildDied)
+		}
+	}
+	restart()
+	before := openFds(t)
+	for i := 0; i < 20; i++ {
+		restart()
+	}
+	if after := openFds(t); before != after {
+		t.Errorf("%d fds open after 20 restarts, %d before", after, before)
+	}
+}
+
+// A setenv failing partway through the fork leaves the GOAGAIN_
+// environment as it was, as if the restart had never been tried.
+func TestForkSetenvFailureRestoresEnv(t *testing.T) {
+	for _, key := range []string{
+		"GOAGAIN_FD",
+		"GOAGAIN_PROTO_VERSION",
+		"GOAGAIN_PPID",
+		"GOAGAIN_ANCESTORS",
+		"GOAGAIN_PID",
+	} {
+		t.Run(key, func(t *testing.T) {
+			keepEnv(t)
+			standIn(t, "sleep", 0)
+			os.Setenv("GOAGAIN_FD", "99")
+			os.Setenv("GOAGAIN_PPID", "1")
+			os.Unsetenv("GOAGAIN_FD_COUNT")
+			before := snapshotEnv()
+			failSetenv(t, key)
+			th := handoff{ls: []net.Listener{listenTCP(t), listenTCP(t)}}
+
+			p, _, err := forkExec(th, syscall.SIGQUIT, ForkOptions{})
+			if nil != p {
+				defer p.Wait()
+				defer p.Kill()
+			}
+			if !errors.Is(err, ErrSetEnv) {
+				t.Fatalf("forkExec: %v, want %v", err, ErrSetEnv)
+			}
+			if after := snapshotEnv(); !reflect.DeepEqual(before, after) {
+				t.Errorf("environment %v after the failure, want %v", after, before)
+			}
+		})
+	}
+}
+
+// A wrapper that unwraps to itself.
+type loopListener struct{ net.Listener }
+
+func (l *loopListener) Unwrap() net.Listener { return l }
+
+// unwrap drills down to the socket through any chain of wrappers, PROXY
+// protocol middleware say, and stops at one that unwraps to nil or itself.
+func TestUnwrap(t *testing.T) {
+	tcp := listenTCP(t)
+	proxy := wrappedListener{NewGracefulListener(wrappedListener{tcp})}
+	if got := unwrap(proxy); tcp != got {
+		t.Errorf("unwrap = %T, want the *net.TCPListener", got)
+	}
+	self := &loopListener{tcp}
+	if got := unwrap(self); self != got {
+		t.Errorf("unwrap of a self-unwrapping listener = %T", got)
+	}
+	var ni nilUnwrapper
+	if got := unwrap(ni); ni != got {
+		t.Errorf("unwrap of a nil-unwrapping listener = %T", got)
+	}
+	f, err := listenerFile(proxy)
+	if nil != err {
+		t.Fatal(err)
+	}
+	f.Close()
+}
+
+type nilUnwrapper struct{ memListener }
+
+func (nilUnwrapper) Unwrap() net.Listener { return nil }
+
+// The binary is looked up on every fork and made absolute, but a symlink to
+// it is left for exec to follow, so re-pointing the symlink swaps the binary
+// the next child runs.
+func TestLookPathLeavesSymlinks(t *testing.T) {
+	args := os.Args
+	defer func() { os.Args = args }()
+	dir := t.TempDir()
+	for _, name := range []string{"v1", "v2"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0755); nil != err {
+			t.Fatal(err)
+		}
+	}
+	current := filepath.Join(dir, "current")
+	if err := os.Symlink("v1", current); nil != err {
+		t.Fatal(err)
+	}
+	t.Chdir(dir)
+	os.Args = []string{"./current"}
+	if got, err := lookPath(); nil != err || current != got {
+		t.Fatalf("lookPath = %q, %v, want %q", got, err, current)
+	}
+	if err := os.Remove(current); nil != err {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("v2", current); nil != err {
+		t.Fatal(err)
+	}
+	if got, err := lookPath(); nil != err || current != got {
+		t.Fatalf("lookPath after the swap = %q, %v, want %q", got, err, current)
+	}
+
+	// A restart hands the symlink itself to the fork, so exec runs
+	// whichever binary it points at by then.
+	keepEnv(t)
+	starts := standIn(t, "exit", 0)
+	for _, target := range []string{"v2", "v1"} {
+		if err := os.Remove(current); nil != err {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, current); nil != err {
+			t.Fatal(err)
+		}
+		p, _, err := forkExec(handoff{ls: []net.Listener{listenTCP(t)}}, syscall.SIGQUIT, ForkOptions{})
+		if nil != err {
+			t.Fatal(err)
+		}
+		p.Wait()
+		got := (*starts)[len(*starts)-1].argv0
+		if current != got {
+			t.Errorf("fork started %q, want the symlink %q", got, current)
+		}
+		want, _ := filepath.EvalSymlinks(filepath.Join(dir, target))
+		if resolved, err := filepath.EvalSymlinks(got); nil != err || want != resolved {
+			t.Errorf("%s resolves to %q, %v, want %s", got, resolved, err, want)
+		}
+	}
+
+	// With nothing to find, the running binary is re-exec'd.
+	self, err := selfExe()
+	if nil != err {
+		t.Skip("can't find the running binary:", err)
+	}
+	for _, argv0 := range []string{"", "./missing"} {
+		os.Args = []string{argv0}
+		if got, err := lookPath(); nil != err || self != got {
+			t.Errorf("lookPath with os.Args[0] %q = %q, %v, want %q", argv0, got, err, self)
+		}
+	}
+}
+
+// Once a restart succeeds, closing the parent's Unix listener leaves the
+// socket's path for the child, which accepts on it; after a failed one,
+// Close unlinks it as usual.
+func TestUnixSocketPathKept(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		child string
+		send  syscall.Signal
+		kept  bool
+	}{
+		{"succeeded", "accept", syscall.SIGQUIT, true},
+		{"failed", "exit", 0, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			keepEnv(t)
+			standIn(t, tt.child, tt.send)
+			path := filepath.Join(t.TempDir(), "sock")
+			l, err := net.Listen("unix", path)
+			if nil != err {
+				t.Fatal(err)
+			}
+			h := NewWithConfig(Config{Timeout: 5 * time.Second})
+			th := handoff{ls: []net.Listener{NewGracefulListener(l)}}
+			th.sigs, _ = h.signals()
+			h.beginResult(RestartResult{OldPid: os.Getpid()})
+			err = h.restart(context.Background(), th, nil)
+			if pid := h.LastResult().NewPid; nil == err && 0 != pid {
+				defer waitGone(t, pid)
+				defer syscall.Kill(pid, syscall.SIGKILL)
+			}
+			l.Close()
+			if _, err := os.Stat(path); tt.kept != (nil == err) {
+				t.Fatalf("socket path after Close: %v", err)
+			}
+			if tt.kept {
+				if got := childSays(t, "unix", path); "ok" != got {
+					t.Errorf("child sent %q on the kept path, want ok", got)
+				}
+			}
+		})
+	}
+}
+
+// With stdin closed, as by a daemon, the dup of a listener lands on fd 0.
+// It's passed above stdio instead, and the listener comes back whole.
+func TestStdioFdRoundTrip(t *testing.T) {
+	l := listenTCP(t)
+	addr := l.Addr().String()
+	stdin, err := syscall.Dup(0)
+	if nil != err {
+		t.Fatal(err)
+	}
+	syscall.Close(0)
+	t.Cleanup(func() {
+		if fd, err := syscall.Dup(stdin); nil != err || 0 != fd {
+			t.Errorf("restoring stdin got fd %d: %v", fd, err)
+		}
+		syscall.Close(stdin)
+	})
+
+	passToSelf(t, l)
+	var fd int
+	fmt.Sscan(os.Getenv("GOAGAIN_FD"), &fd)
+	if fd <= syscall.Stderr {
+		t.Fatalf("passed at fd %d, among the child's stdio", fd)
+	}
+	inherited, err := Listener()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer inherited.Close()
+	if got := inherited.Addr().String(); addr != got {
+		t.Errorf("inherited listener on %s, want %s", got, addr)
+	}
+}
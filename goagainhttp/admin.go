@@ -0,0 +1,211 @@
+package goagainhttp
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/blamarvt/goagain"
+)
+
+// An http.Handler giving operators a control plane for a goagain.Handler:
+//
+//	POST /restart      send ourselves the fork signal
+//	GET  /status       this generation's pid, lineage and listeners
+//	GET  /connections  open connections and the latest drain progress
+//	GET  /history      recent restarts and counts by outcome
+//
+// Responses are JSON.  The paths are relative, so mount it under a prefix
+// with http.StripPrefix.  It does no authentication of its own: POST
+// /restart in the wrong hands is a restart on demand, so put it behind the
+// same auth as the rest of your admin endpoints.
+type Admin struct {
+	h *goagain.Handler
+	t *goagain.Tracker
+
+	mu       sync.Mutex
+	progress *drainProgress
+}
+
+type drainProgress struct {
+	Remaining int       `json:"remaining"`
+	Elapsed   string    `json:"elapsed"`
+	At        time.Time `json:"at"`
+}
+
+// Serve h's controls and status.  t, if not nil, is the Tracker draining the
+// server's connections; its DrainProgress hook is chained to feed
+// /connections, so set any hook of your own first.  With a nil t,
+// /connections is not found.
+func NewAdmin(h *goagain.Handler, t *goagain.Tracker) *Admin {
+	a := &Admin{h: h, t: t}
+	if nil != t {
+		hook := t.DrainProgress
+		t.DrainProgress = func(remaining int, elapsed time.Duration) {
+			a.mu.Lock()
+			a.progress = &drainProgress{remaining, elapsed.String(), time.Now()}
+			a.mu.Unlock()
+			if nil != hook {
+				hook(remaining, elapsed)
+			}
+		}
+	}
+	return a
+}
+
+// Route r to the endpoint it names.
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	method, serve := http.MethodGet, http.HandlerFunc(nil)
+	switch strings.TrimPrefix(r.URL.Path, "/") {
+	case "restart":
+		method, serve = http.MethodPost, a.restart
+	case "status":
+		serve = a.status
+	case "connections":
+		if nil != a.t {
+			serve = a.connections
+		}
+	case "history":
+		serve = a.history
+	}
+	switch {
+	case nil == serve:
+		http.NotFound(w, r)
+	case method != r.Method:
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, errors.New(method+" only"))
+	default:
+		serve(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
+
+var errRestarting = errors.New("a restart is already in progress")
+
+// Trigger a restart the way an operator's kill -HUP would.  The restart
+// itself runs asynchronously; watch /history for how it ends.
+func (a *Admin) restart(w http.ResponseWriter, r *http.Request) {
+	if a.h.Restarting() {
+		writeError(w, http.StatusConflict, errRestarting)
+		return
+	}
+	fork, _, _, _ := a.h.Signals()
+	if err := kill(os.Getpid(), fork); nil != err {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, struct {
+		Signal string `json:"signal"`
+	}{fork.String()})
+}
+
+// Send sig to pid, trying again if a signal arriving mid-call interrupts it,
+// as goagain does for its own signals.
+func kill(pid int, sig syscall.Signal) error {
+	for {
+		if err := syscall.Kill(pid, sig); syscall.EINTR != err {
+			return err
+		}
+	}
+}
+
+type statusJSON struct {
+	Pid             int                    `json:"pid"`
+	Ppid            int                    `json:"ppid,omitempty"`
+	Generation      int                    `json:"generation"`
+	Restarting      bool                   `json:"restarting"`
+	ProtocolVersion int                    `json:"protocol_version"`
+	Listeners       []goagain.ListenerDiag `json:"listeners"`
+	EnvError        string                 `json:"env_error,omitempty"`
+}
+
+func (a *Admin) status(w http.ResponseWriter, r *http.Request) {
+	info, err := goagain.Env()
+	s := statusJSON{
+		Pid:             os.Getpid(),
+		Ppid:            info.Ppid,
+		Generation:      info.Generation,
+		Restarting:      a.h.Restarting(),
+		ProtocolVersion: goagain.ProtocolVersion(),
+		Listeners:       goagain.ListenerDiagnostics(),
+	}
+	if nil != err {
+		s.EnvError = err.Error()
+	}
+	writeJSON(w, http.StatusOK, s)
+}
+
+func (a *Admin) connections(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	progress := a.progress
+	a.mu.Unlock()
+	writeJSON(w, http.StatusOK, struct {
+		Active int            `json:"active"`
+		Drain  *drainProgress `json:"drain,omitempty"`
+	}{a.t.Active(), progress})
+}
+
+// A RestartResult as JSON, with the interfaces a plain encoding would mangle
+// turned into strings.
+type restartJSON struct {
+	OldPid      int             `json:"old_pid"`
+	NewPid      int             `json:"new_pid,omitempty"`
+	Start       time.Time       `json:"start"`
+	Signal      string          `json:"signal,omitempty"`
+	Outcome     goagain.Outcome `json:"outcome"`
+	Error       string          `json:"error,omitempty"`
+	ChildAddr   string          `json:"child_addr,omitempty"`
+	ForkToReady string          `json:"fork_to_ready"`
+	Handoff     string          `json:"handoff"`
+}
+
+func newRestartJSON(res goagain.RestartResult) restartJSON {
+	j := restartJSON{
+		OldPid:      res.OldPid,
+		NewPid:      res.NewPid,
+		Start:       res.Start,
+		Outcome:     res.Outcome,
+		ForkToReady: res.Timing.ForkToReady.String(),
+		Handoff:     res.Timing.Handoff.String(),
+	}
+	if nil != res.Signal {
+		j.Signal = res.Signal.String()
+	}
+	if nil != res.Err {
+		j.Error = res.Err.Error()
+	}
+	if nil != res.ChildAddr {
+		j.ChildAddr = res.ChildAddr.String()
+	}
+	return j
+}
+
+func (a *Admin) history(w http.ResponseWriter, r *http.Request) {
+	results := a.h.History()
+	restarts := make([]restartJSON, len(results))
+	outcomes := make(map[goagain.Outcome]int)
+	for i, res := range results {
+		restarts[i] = newRestartJSON(res)
+		outcomes[res.Outcome]++
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Restarts []restartJSON           `json:"restarts"`
+		Outcomes map[goagain.Outcome]int `json:"outcomes"`
+	}{restarts, outcomes})
+}
@@ -0,0 +1,142 @@
+// Serve an http.Server across goagain restarts, handing its listener to each
+// new generation and draining the old one's connections, keep-alive ones
+// included, once the new one has taken over.
+package goagainhttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/blamarvt/goagain"
+)
+
+// Serve srv on the listener our parent passed for srv.Addr or, on first boot,
+// a fresh one, confirming to the parent that we've taken over, and restart
+// as cfg says, as often as it takes for one to succeed.  A failed restart
+// leaves srv serving as before.
+//
+// Once the child takes over, keep-alives are disabled so each response on an
+// existing connection carries Connection: close and clients reconnect, to
+// the child, between requests rather than having one cut off mid-pipeline.
+// Then srv is shut down, waiting up to drainTimeout, or indefinitely if it's
+// zero, for requests in flight to finish, after which any connections left
+// are force-closed.  Connections only close between requests so this works
+// best combined with ForkOptions.StandbyDuration, during which the child
+// takes new connections while the parent finishes the requests on its own
+// with keep-alives off.
+func ServeHTTP(srv *http.Server, cfg goagain.Config, drainTimeout time.Duration) error {
+	_, err := ServeHTTPResult(srv, cfg, drainTimeout)
+	return err
+}
+
+// Serve like ServeHTTP and also report the successful restart's result,
+// including how many connections drained and how many were force-closed,
+// held to cfg.MaxForceClose.
+func ServeHTTPResult(srv *http.Server, cfg goagain.Config, drainTimeout time.Duration) (res goagain.RestartResult, err error) {
+	addr := srv.Addr
+	if "" == addr {
+		addr = ":http"
+	}
+	l, inherited, err := goagain.ListenAndInherit("tcp", addr)
+	if nil != err {
+		return
+	}
+	conns := trackConns(srv)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(l)
+	}()
+	if inherited {
+		if err = goagain.SignalReady(); nil != err {
+			return
+		}
+	}
+
+	onHandoff := cfg.OnHandoff
+	cfg.OnHandoff = func(pid int) {
+		srv.SetKeepAlivesEnabled(false)
+		if nil != onHandoff {
+			onHandoff(pid)
+		}
+	}
+	h := goagain.NewWithConfig(cfg)
+	for {
+		waitErr := make(chan error, 1)
+		go func() {
+			waitErr <- h.Wait(l)
+		}()
+		select {
+		case err = <-serveErr:
+			return h.LastResult(), err
+		case err = <-waitErr:
+		}
+		if nil == err {
+			break
+		}
+		if nil != goagain.Logger {
+			goagain.Logger.Println("restart failed, still serving:", err)
+		}
+		srv.SetKeepAlivesEnabled(true)
+	}
+
+	res = h.LastResult()
+	ctx := context.Background()
+	if 0 < drainTimeout {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, drainTimeout)
+		defer cancel()
+	}
+	drainStart := time.Now()
+	open := conns.count()
+	err = srv.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		res.ForceClosed = conns.count()
+		srv.Close()
+		err = fmt.Errorf("%w: force-closed %d connections", goagain.ErrDrainTimeout, res.ForceClosed)
+	}
+	res.Drained = open - res.ForceClosed
+	res.Timing.Drain = time.Since(drainStart)
+	if 0 < cfg.MaxForceClose && res.ForceClosed > cfg.MaxForceClose {
+		res.Outcome = goagain.OutcomeTooDisruptive
+		res.Err = fmt.Errorf("%w: %d force-closed, budget %d", goagain.ErrTooDisruptive, res.ForceClosed, cfg.MaxForceClose)
+		err = errors.Join(res.Err, err)
+	}
+	return
+}
+
+// The connections srv has open, counted through its ConnState hook.
+type connCounter struct {
+	mu   sync.Mutex
+	open map[net.Conn]struct{}
+}
+
+// Count srv's connections from now on, chaining any ConnState hook it has.
+func trackConns(srv *http.Server) *connCounter {
+	c := &connCounter{open: make(map[net.Conn]struct{})}
+	hook := srv.ConnState
+	srv.ConnState = func(conn net.Conn, state http.ConnState) {
+		c.mu.Lock()
+		switch state {
+		case http.StateNew:
+			c.open[conn] = struct{}{}
+		case http.StateHijacked, http.StateClosed:
+			delete(c.open, conn)
+		}
+		c.mu.Unlock()
+		if nil != hook {
+			hook(conn, state)
+		}
+	}
+	return c
+}
+
+func (c *connCounter) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.open)
+}
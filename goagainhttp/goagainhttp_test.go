@@ -0,0 +1,208 @@
+package goagainhttp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/blamarvt/goagain"
+)
+
+// The test binary doubles as the child, which confirms the handoff as soon
+// as it starts and then idles until killed.
+func TestMain(m *testing.M) {
+	if "ready" == os.Getenv("STANDIN_CHILD") {
+		goagain.SignalReady()
+		time.Sleep(time.Minute)
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// A server whose /slow requests block until release is closed, restarted
+// into a stand-in child on SIGUSR1.
+type slowServer struct {
+	srv       *http.Server
+	cfg       goagain.Config
+	release   chan struct{}
+	inFlight  chan struct{}
+	handedOff chan struct{}
+}
+
+func newSlowServer(t *testing.T) *slowServer {
+	s := &slowServer{
+		release:   make(chan struct{}),
+		inFlight:  make(chan struct{}, 1),
+		handedOff: make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		s.inFlight <- struct{}{}
+		<-s.release
+		io.WriteString(w, "done")
+	})
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	l.Close()
+	s.srv = &http.Server{Addr: l.Addr().String(), Handler: mux}
+	s.cfg = goagain.Config{
+		ForkSignal:  syscall.SIGUSR1,
+		Timeout:     5 * time.Second,
+		ForkOptions: goagain.ForkOptions{Argv0: os.Args[0]},
+		OnHandoff:   func(int) { close(s.handedOff) },
+	}
+	goagain.Init(syscall.SIGUSR1)
+	t.Setenv("STANDIN_CHILD", "ready")
+	return s
+}
+
+// Start a /slow request and wait for it to reach the handler.  The
+// response is nil if the request failed.
+func (s *slowServer) get(t *testing.T) <-chan *http.Response {
+	respCh := make(chan *http.Response, 1)
+	go func() {
+		for i := 0; i < 500; i++ {
+			resp, err := http.Get("http://" + s.srv.Addr + "/slow")
+			if nil == err {
+				respCh <- resp
+				return
+			}
+			if !errors.Is(err, syscall.ECONNREFUSED) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		respCh <- nil
+	}()
+	<-s.inFlight
+	return respCh
+}
+
+// Fetch /ping on a connection of its own, retrying while the server is
+// still starting.
+func (s *slowServer) ping() error {
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	for i := 0; ; i++ {
+		resp, err := client.Get("http://" + s.srv.Addr + "/ping")
+		if nil == err {
+			resp.Body.Close()
+			return nil
+		}
+		if !errors.Is(err, syscall.ECONNREFUSED) || 500 == i {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Serve until the restart is over, in the background.
+func (s *slowServer) serve(drainTimeout time.Duration) <-chan result {
+	done := make(chan result, 1)
+	go func() {
+		res, err := ServeHTTPResult(s.srv, s.cfg, drainTimeout)
+		done <- result{res, err}
+	}()
+	return done
+}
+
+type result struct {
+	res goagain.RestartResult
+	err error
+}
+
+// Kill the child the restart left running.
+func (r result) kill() {
+	if 0 != r.res.NewPid {
+		syscall.Kill(r.res.NewPid, syscall.SIGKILL)
+	}
+}
+
+// A request in flight at the handoff finishes, with Connection: close so the
+// client reconnects to the child, and counts as drained.  It's released
+// once Shutdown starts, so it's still open when the drain begins.
+func TestServeHTTPDrainsKeepAlive(t *testing.T) {
+	s := newSlowServer(t)
+	s.srv.RegisterOnShutdown(func() { close(s.release) })
+	done := s.serve(time.Minute)
+	respCh := s.get(t)
+	syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+	<-s.handedOff
+
+	resp := <-respCh
+	if nil == resp {
+		t.Fatal("request in flight at the handoff failed")
+	}
+	resp.Body.Close()
+	if !resp.Close {
+		t.Error("response after the handoff kept the connection alive")
+	}
+	r := <-done
+	defer r.kill()
+	if nil != r.err {
+		t.Fatal(r.err)
+	}
+	if 1 != r.res.Drained || 0 != r.res.ForceClosed {
+		t.Errorf("drained %d, force-closed %d, want 1 and 0", r.res.Drained, r.res.ForceClosed)
+	}
+}
+
+// A request still running at the drain timeout is cut off and counted.
+func TestServeHTTPDrainTimeout(t *testing.T) {
+	s := newSlowServer(t)
+	defer close(s.release)
+	done := s.serve(100 * time.Millisecond)
+	respCh := s.get(t)
+	syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+
+	r := <-done
+	defer r.kill()
+	if !errors.Is(r.err, goagain.ErrDrainTimeout) {
+		t.Fatalf("ServeHTTPResult: %v, want %v", r.err, goagain.ErrDrainTimeout)
+	}
+	if 0 != r.res.Drained || 1 != r.res.ForceClosed {
+		t.Errorf("drained %d, force-closed %d, want 0 and 1", r.res.Drained, r.res.ForceClosed)
+	}
+	if resp := <-respCh; nil != resp {
+		resp.Body.Close()
+		t.Error("request cut off by the drain timeout got a response")
+	}
+}
+
+// Shutdown finishes with no client connecting after the handoff, though the
+// accept loop went back to Accept after the fork, on a socket the fork
+// mustn't have left blocking.
+func TestServeHTTPShutdownAfterFork(t *testing.T) {
+	s := newSlowServer(t)
+	handedOff := s.cfg.OnHandoff
+	s.cfg.OnHandoff = func(pid int) {
+		if err := s.ping(); nil != err {
+			t.Error(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+		handedOff(pid)
+	}
+	done := s.serve(time.Minute)
+	if err := s.ping(); nil != err {
+		t.Fatal(err)
+	}
+	syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+
+	select {
+	case r := <-done:
+		defer r.kill()
+		if nil != r.err {
+			t.Fatal(r.err)
+		}
+	case <-time.After(10 * time.Second):
+		s.ping()
+		t.Fatal("ServeHTTPResult still shutting down with no client connecting")
+	}
+}
@@ -0,0 +1,290 @@
+package goagain
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Returned by Drain when connections were still open at the deadline and had
+// to be closed.
+var ErrDrainTimeout = errors.New("timed out draining connections")
+
+// A net.Listener that tracks the connections it accepts so the outgoing
+// generation can wait for them to finish before it exits.  The tracking,
+// and with it Drain, Notify and DrainProgress, is its Tracker's.
+type GracefulListener struct {
+	net.Listener
+	*Tracker
+
+	stopped atomic.Bool
+}
+
+// A pool of connections, and of TrackWork jobs, to drain together, fed by
+// one or more GracefulListeners.
+type Tracker struct {
+
+	// Called by Drain on each open connection before it starts waiting, for
+	// a protocol that can tell clients to reconnect, say with a WebSocket
+	// close frame, rather than have them cut off.  An error is logged and
+	// the connection is drained like the rest.  Nil skips the step.
+	Notify func(net.Conn) error
+
+	// Called by Drain every DrainProgressInterval with the number of
+	// connections and TrackWork jobs still open and how long it's been
+	// draining, for a "draining: 12 connections remaining" log line or
+	// status page.  It stops once the drain finishes or times out.  Nil
+	// stays silent.
+	DrainProgress func(remaining int, elapsed time.Duration)
+
+	// Defaults to a second.
+	DrainProgressInterval time.Duration
+
+	mu    sync.Mutex
+	conns map[*gracefulConn]struct{}
+	work  int
+	wg    sync.WaitGroup
+}
+
+// Wrap l to track accepted connections.  The result may be passed to Wait in
+// place of l.
+func NewGracefulListener(l net.Listener) *GracefulListener {
+	return NewTracker().Wrap(l)
+}
+
+// Make an empty Tracker for GracefulListeners to share, say the public and
+// admin listeners of a server that keeps every connection in one pool.
+func NewTracker() *Tracker {
+	return &Tracker{conns: make(map[*gracefulConn]struct{})}
+}
+
+// Wrap l like NewGracefulListener but track its connections in t.  Every
+// listener wrapped this way shares t's state, so draining any of them waits
+// for the connections from all of them; close them all first.
+func (t *Tracker) Wrap(l net.Listener) *GracefulListener {
+	return &GracefulListener{Listener: l, Tracker: t}
+}
+
+// Accept a connection and track it until it's closed.
+func (l *GracefulListener) Accept() (net.Conn, error) {
+	if l.stopped.Load() {
+		return nil, l.errStopped()
+	}
+	c, err := l.Listener.Accept()
+	if nil != err {
+		return nil, err
+	}
+	gc := &gracefulConn{Conn: c, t: l.Tracker}
+	l.mu.Lock()
+	l.conns[gc] = struct{}{}
+	l.wg.Add(1)
+	l.mu.Unlock()
+	return gc, nil
+}
+
+// Have Drain wait for done to be closed as well as for the connections, for
+// work that outlives the request that started it, say an asynchronous job
+// finishing a write.  The drain timeout applies to it too, but unlike a
+// connection there's nothing to force-close: work still running at the
+// deadline is abandoned, and the process may exit under it.
+func (t *Tracker) TrackWork(done <-chan struct{}) {
+	t.mu.Lock()
+	t.work++
+	t.wg.Add(1)
+	t.mu.Unlock()
+	go func() {
+		<-done
+		t.mu.Lock()
+		t.work--
+		t.mu.Unlock()
+		t.wg.Done()
+	}()
+}
+
+// The number of accepted connections not yet closed.
+func (t *Tracker) Active() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// Wait for every tracked connection to close, returning as soon as the last
+// one does.  Any still open after timeout are closed and ErrDrainTimeout is
+// returned; a zero timeout waits indefinitely.  Stop accepting, usually by
+// closing the listener, first.  The timeout starts once Notify has been
+// called on every connection.
+func (t *Tracker) Drain(timeout time.Duration) error {
+	_, err := t.drain(timeout)
+	return err
+}
+
+// Drain, also reporting how many connections had to be force-closed.
+func (t *Tracker) drain(timeout time.Duration) (forced int, err error) {
+	if nil != t.Notify {
+		t.notifyAll()
+	}
+	doneCh := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(doneCh)
+	}()
+	var progressCh <-chan time.Time
+	if nil != t.DrainProgress {
+		interval := t.DrainProgressInterval
+		if 0 >= interval {
+			interval = time.Second
+		}
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		progressCh = tick.C
+	}
+	start := time.Now()
+	deadline := after(timeout)
+	for waiting := true; waiting; {
+		select {
+		case <-doneCh:
+			return 0, nil
+		case <-progressCh:
+			t.DrainProgress(t.Active()+t.pendingWork(), time.Since(start))
+		case <-deadline:
+			waiting = false
+		}
+	}
+	n := t.closeAll()
+	logln("Force-closed", n, "connections after", timeout)
+	if w := t.pendingWork(); 0 < w {
+		logln("Abandoning", w, "tracked jobs after", timeout)
+		return n, fmt.Errorf("%w: force-closed %d connections and abandoned %d jobs", ErrDrainTimeout, n, w)
+	}
+	return n, fmt.Errorf("%w: force-closed %d connections", ErrDrainTimeout, n)
+}
+
+// Block until stopSignal, then stop accepting on l and drain it, with no new
+// generation: for a scale-down or any time the process should just shut down
+// nicely.  Connections are only tracked, and so drained, if l is a
+// *GracefulListener.
+func GracefulStop(l net.Listener, stopSignal syscall.Signal, drainTimeout time.Duration) error {
+	stopCh := make(chan os.Signal, 1)
+	signal.Notify(stopCh, stopSignal)
+	defer signal.Stop(stopCh)
+
+	logln("Waiting for stop signal from system...")
+	<-stopCh
+	logln("Received stop signal, draining.")
+
+	if err := l.Close(); nil != err {
+		return err
+	}
+	if gl, ok := l.(*GracefulListener); ok {
+		return gl.Drain(drainTimeout)
+	}
+	return nil
+}
+
+// Stop accepting, without closing the socket, at the moment the child takes
+// over.  Call it from Config.OnHandoff, which runs once the child has sent
+// the quit signal and passed Verify, then close the listener and Drain after
+// Wait returns.  Accept, even one already blocked, fails with an error
+// IsErrClosing recognizes, so the accept loop winds down as it would after
+// Close.  Nothing queued is lost: connections the kernel has yet to hand to
+// Accept stay on the socket the child shares.  ResumeAccepting undoes it.
+func (l *GracefulListener) StopAccepting() error {
+	l.stopped.Store(true)
+	if dl, ok := unwrap(l.Listener).(deadliner); ok {
+		return dl.SetDeadline(time.Now())
+	}
+	return nil
+}
+
+// Undo StopAccepting, so Accept works again, say to serve on after the
+// child that took over exits during ForkOptions.StandbyDuration.  goagain
+// does this itself for the listeners it was given when it resumes after
+// standby.  An accept loop that already wound down has to be started again.
+func (l *GracefulListener) ResumeAccepting() error {
+	l.stopped.Store(false)
+	if dl, ok := unwrap(l.Listener).(deadliner); ok {
+		return dl.SetDeadline(time.Time{})
+	}
+	return nil
+}
+
+// The error Accept returns after StopAccepting.
+func (l *GracefulListener) errStopped() error {
+	return &net.OpError{
+		Op:   "accept",
+		Net:  l.Addr().Network(),
+		Addr: l.Addr(),
+		Err:  net.ErrClosed,
+	}
+}
+
+func (l *GracefulListener) Unwrap() net.Listener {
+	return l.Listener
+}
+
+// The number of TrackWork jobs not yet done.
+func (t *Tracker) pendingWork() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.work
+}
+
+// Close every tracked connection and report how many there were.
+func (t *Tracker) closeAll() int {
+	conns := t.snapshot()
+	for _, c := range conns {
+		c.Close()
+	}
+	return len(conns)
+}
+
+// Hand every tracked connection to Notify.
+func (t *Tracker) notifyAll() {
+	for _, c := range t.snapshot() {
+		if err := t.Notify(c); nil != err {
+			logln("Unable to notify", c.RemoteAddr(), "of the restart", err)
+		}
+	}
+}
+
+// The connections tracked right now.
+func (t *Tracker) snapshot() []*gracefulConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	conns := make([]*gracefulConn, 0, len(t.conns))
+	for c := range t.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+func (t *Tracker) forget(c *gracefulConn) {
+	t.mu.Lock()
+	delete(t.conns, c)
+	t.mu.Unlock()
+	t.wg.Done()
+}
+
+// A connection that tells its Tracker when it's closed.
+type gracefulConn struct {
+	net.Conn
+	t    *Tracker
+	once sync.Once
+}
+
+func (c *gracefulConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { c.t.forget(c) })
+	return err
+}
+
+// The connection underneath, so TransferConn can find its fd.
+func (c *gracefulConn) Unwrap() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,282 @@
+package goagain
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Accept a connection dialled to l, failing t if it takes too long.
+func acceptOne(t *testing.T, l net.Listener) error {
+	c, err := net.Dial("tcp", l.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		ac, err := l.Accept()
+		if nil == err {
+			ac.Close()
+		}
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept still blocked")
+		return nil
+	}
+}
+
+// Start an Accept on l with nothing queued, so it blocks, and give it a
+// moment to get there.
+func blockedAccept(l net.Listener) <-chan error {
+	errCh := make(chan error, 1)
+	go func() {
+		c, err := l.Accept()
+		if nil == err {
+			c.Close()
+		}
+		errCh <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	return errCh
+}
+
+// The error the Accept blockedAccept started returned.  One stuck in the
+// kernel, where a deadline can't reach it, is let go with a connection so
+// the test can clean up.
+func released(t *testing.T, l net.Listener, errCh <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-errCh:
+		return err
+	case <-time.After(5 * time.Second):
+		if c, err := net.Dial(l.Addr().Network(), l.Addr().String()); nil == err {
+			c.Close()
+		}
+		t.Fatal("blocked Accept wasn't released")
+		return nil
+	}
+}
+
+// Dial l and send a byte, for queued to find.
+func sendQueued(t *testing.T, l net.Listener) {
+	c, err := net.Dial(l.Addr().Network(), l.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if _, err := c.Write([]byte("q")); nil != err {
+		t.Fatal(err)
+	}
+}
+
+// Accept the connection sendQueued made, failing t if it's been lost.
+func queued(t *testing.T, l net.Listener) {
+	t.Helper()
+	connCh := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if nil != err {
+			t.Error(err)
+		}
+		connCh <- c
+	}()
+	var c net.Conn
+	select {
+	case c = <-connCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued connection never accepted")
+	}
+	if nil == c {
+		t.FailNow()
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 1)
+	if _, err := c.Read(b); nil != err || "q" != string(b) {
+		t.Errorf("read %q, %v from the queued connection", b, err)
+	}
+}
+
+// StopAccepting lets go of an Accept already blocked, and a connection
+// queued meanwhile is accepted after ResumeAccepting.  That has to hold
+// after a restart too, whose File and Fd calls mustn't leave the listener's
+// socket in blocking mode.
+func TestStopResumeAccepting(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		prep func(*testing.T, net.Listener)
+	}{
+		{"fresh", func(*testing.T, net.Listener) {}},
+		{"after a restart", func(t *testing.T, l net.Listener) { forkOnce(t, l) }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewGracefulListener(listenTCP(t))
+			tt.prep(t, l)
+			errCh := blockedAccept(l)
+			if err := l.StopAccepting(); nil != err {
+				t.Fatal(err)
+			}
+			if err := released(t, l, errCh); !IsErrClosing(err) {
+				t.Fatalf("blocked Accept after StopAccepting: %v", err)
+			}
+			if _, err := l.Accept(); !IsErrClosing(err) {
+				t.Fatalf("Accept after StopAccepting: %v", err)
+			}
+			sendQueued(t, l)
+			if err := l.ResumeAccepting(); nil != err {
+				t.Fatal(err)
+			}
+			queued(t, l)
+		})
+	}
+}
+
+// A child exiting during standby leaves the parent accepting again, even on
+// a wrapped listener OnHandoff stopped.
+func TestStandbyResumesOnChildExit(t *testing.T) {
+	gl := NewGracefulListener(listenTCP(t))
+	l := wrappedListener{gl}
+	if err := gl.StopAccepting(); nil != err {
+		t.Fatal(err)
+	}
+	exited := make(chan struct{})
+	close(exited)
+	err := standby([]net.Listener{l}, &os.Process{Pid: -1}, exited, time.Minute)
+	if !errors.Is(err, ErrChildExited) {
+		t.Fatalf("standby: %v, want %v", err, ErrChildExited)
+	}
+	if err := acceptOne(t, l); nil != err {
+		t.Fatalf("Accept after standby: %v", err)
+	}
+}
+
+// Standby stops an Accept the parent already has blocked on a listener a
+// real fork handed on, and starts it again once the child dies, without
+// losing the connection queued in between.
+func TestStandbyAfterFork(t *testing.T) {
+	keepEnv(t)
+	standIn(t, "sleep", 0)
+	l := listenTCP(t)
+	p, _, err := forkExec(handoff{ls: []net.Listener{l}}, syscall.SIGQUIT, ForkOptions{})
+	if nil != err {
+		t.Fatal(err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		p.Wait()
+		close(exited)
+	}()
+	t.Cleanup(func() {
+		p.Kill()
+		<-exited
+	})
+
+	errCh := blockedAccept(l)
+	done := make(chan error, 1)
+	go func() {
+		done <- standby([]net.Listener{l}, p, exited, time.Minute)
+	}()
+	if err := released(t, l, errCh); !IsErrClosing(err) {
+		t.Fatalf("blocked Accept during standby: %v", err)
+	}
+	sendQueued(t, l)
+	p.Kill()
+	if err := <-done; !errors.Is(err, ErrChildExited) {
+		t.Fatalf("standby: %v, want %v", err, ErrChildExited)
+	}
+	queued(t, l)
+}
+
+type wrappedListener struct{ net.Listener }
+
+func (l wrappedListener) Unwrap() net.Listener { return l.Listener }
+
+// Dial l and accept the connection, returning both ends.
+func dialAccept(t *testing.T, l net.Listener) (client, server net.Conn) {
+	client, err := net.Dial(l.Addr().Network(), l.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	if server, err = l.Accept(); nil != err {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+// Drain returns once the last connection closes, not at the timeout, and
+// a connection closed twice only counts once.
+func TestDrainReturnsOnLastClose(t *testing.T) {
+	l := NewGracefulListener(listenTCP(t))
+	_, a := dialAccept(t, l)
+	_, b := dialAccept(t, l)
+	a.Close()
+	a.Close()
+	if n := l.Active(); 1 != n {
+		t.Fatalf("%d connections active, want 1", n)
+	}
+	time.AfterFunc(50*time.Millisecond, func() { b.Close() })
+	start := time.Now()
+	if err := l.Drain(time.Minute); nil != err {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("Drain took %v", d)
+	}
+}
+
+// Connections still open at the timeout are force-closed.
+func TestDrainTimeoutForceCloses(t *testing.T) {
+	l := NewGracefulListener(listenTCP(t))
+	client, _ := dialAccept(t, l)
+	forced, err := l.drain(50 * time.Millisecond)
+	if !errors.Is(err, ErrDrainTimeout) {
+		t.Fatalf("drain: %v, want %v", err, ErrDrainTimeout)
+	}
+	if 1 != forced {
+		t.Errorf("%d connections force-closed, want 1", forced)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); nil == err || os.IsTimeout(err) {
+		t.Errorf("read from force-closed connection: %v", err)
+	}
+	if n := l.Active(); 0 != n {
+		t.Errorf("%d connections still active", n)
+	}
+}
+
+// Listeners sharing a Tracker count and drain their connections together.
+func TestSharedTracker(t *testing.T) {
+	tr := NewTracker()
+	pub, admin := tr.Wrap(listenTCP(t)), tr.Wrap(listenTCP(t))
+	_, a := dialAccept(t, pub)
+	_, b := dialAccept(t, admin)
+	if n := pub.Active(); 2 != n {
+		t.Fatalf("%d connections active, want 2", n)
+	}
+	a.Close()
+	if n := admin.Active(); 1 != n {
+		t.Fatalf("%d connections active after one closed, want 1", n)
+	}
+	closing := make(chan struct{})
+	time.AfterFunc(50*time.Millisecond, func() {
+		close(closing)
+		b.Close()
+	})
+	if err := tr.Drain(time.Minute); nil != err {
+		t.Fatal(err)
+	}
+	select {
+	case <-closing:
+	default:
+		t.Error("Drain returned before the other listener's connection closed")
+	}
+}
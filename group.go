@@ -0,0 +1,171 @@
+package goagain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Several independent servers in one process, each with its own listener,
+// handed off together on one fork signal.  In the child, reconstruct the
+// listeners with Listeners and Add them in the same order as the parent did.
+type Group struct {
+
+	// How long each server's connections get to close after the handoff
+	// before they're force-closed, unless it was added with its own timeout
+	// by AddWithDrainTimeout.  Zero waits indefinitely.
+	DrainTimeout time.Duration
+
+	h       *Handler
+	servers []*groupServer
+}
+
+type groupServer struct {
+	l     *GracefulListener
+	serve func(net.Listener) error
+
+	// The server's own drain timeout, if it has one.
+	drainTimeout    time.Duration
+	hasDrainTimeout bool
+}
+
+// Make a Group whose restarts are governed by h.
+func NewGroup(h *Handler) *Group {
+	return &Group{h: h}
+}
+
+// Register a server that accepts on l by calling serve, which should return
+// once l is closed.  Connections are tracked so they can be drained.  A
+// GracefulListener is used as is, so its connections stay in its own
+// Tracker, say one shared with an admin listener outside the Group.
+func (g *Group) Add(l net.Listener, serve func(net.Listener) error) error {
+	_, err := g.add(l, serve)
+	return err
+}
+
+// Add like Add but give this server its own drain timeout in place of
+// DrainTimeout, say a minute for a websocket server alongside an API whose
+// requests finish in seconds.  Zero waits indefinitely.
+func (g *Group) AddWithDrainTimeout(l net.Listener, serve func(net.Listener) error, timeout time.Duration) error {
+	s, err := g.add(l, serve)
+	if nil != err {
+		return err
+	}
+	s.drainTimeout, s.hasDrainTimeout = timeout, true
+	return nil
+}
+
+func (g *Group) add(l net.Listener, serve func(net.Listener) error) (*groupServer, error) {
+	if err := Validate(l); nil != err {
+		return nil, err
+	}
+	if name := ListenerName(l); "" != name {
+		for _, s := range g.servers {
+			if name == ListenerName(s.l) {
+				return nil, fmt.Errorf("more than one listener named %q", name)
+			}
+		}
+	}
+	gl, ok := l.(*GracefulListener)
+	if !ok {
+		gl = NewGracefulListener(l)
+	}
+	s := &groupServer{
+		l:     gl,
+		serve: serve,
+	}
+	g.servers = append(g.servers, s)
+	return s, nil
+}
+
+// Start every server, wait for a restart that hands all of their listeners to
+// one child, then stop accepting and drain every server concurrently.  A
+// failed restart leaves the servers running and waits for the next fork
+// signal.  A server whose drain times out has its remaining connections
+// force-closed without holding up the others; the returned error joins each
+// such failure.
+func (g *Group) Run() error {
+	_, err := g.RunResult()
+	return err
+}
+
+// Run like Run and also report the successful restart's result, drain
+// included.  Beyond Config.MaxForceClose the error includes
+// ErrTooDisruptive.
+func (g *Group) RunResult() (RestartResult, error) {
+	ls := make([]net.Listener, len(g.servers))
+	for i, s := range g.servers {
+		ls[i] = s.l
+		go func(s *groupServer) {
+			if err := s.serve(s.l); nil != err && !IsGracefulClose(err) {
+				logln("server on", s.l.Addr(), "stopped:", err)
+			}
+		}(s)
+	}
+
+	for {
+		err := g.h.wait(context.Background(), handoff{ls: ls})
+		if nil == err {
+			break
+		}
+		logln("Restart failed, still serving:", err)
+	}
+
+	drainStart := time.Now()
+	drains, err := g.drain()
+	g.h.recordResult(func(r *RestartResult) {
+		r.Timing.Drain = time.Since(drainStart)
+		r.Servers = drains
+		for _, d := range drains {
+			r.Drained += d.Drained
+			r.ForceClosed += d.ForceClosed
+		}
+		g.h.checkForceClose(r)
+	})
+	res := g.h.LastResult()
+	if OutcomeTooDisruptive == res.Outcome {
+		err = errors.Join(res.Err, err)
+	}
+	return res, err
+}
+
+// Drain every server concurrently, each against its own timeout, and report
+// how each went.  One that's slow or fails doesn't hold up the others.
+func (g *Group) drain() ([]ServerDrain, error) {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	drains := make([]ServerDrain, len(g.servers))
+	for i, s := range g.servers {
+		wg.Add(1)
+		go func(d *ServerDrain, s *groupServer) {
+			defer wg.Done()
+			timeout := g.DrainTimeout
+			if s.hasDrainTimeout {
+				timeout = s.drainTimeout
+			}
+			start := time.Now()
+			d.Addr = s.l.Addr()
+			err := s.l.Close()
+			active := s.l.Active()
+			n, dErr := s.l.drain(timeout)
+			if nil != dErr {
+				err = dErr
+			}
+			d.Drained, d.ForceClosed = active-n, n
+			d.Duration, d.Err = time.Since(start), err
+			if nil != err {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("%v: %w", d.Addr, err))
+				mu.Unlock()
+			}
+		}(&drains[i], s)
+	}
+	wg.Wait()
+	return drains, errors.Join(errs...)
+}
@@ -0,0 +1,22 @@
+package goagain
+
+import "testing"
+
+// A GracefulListener is tracked as it is rather than wrapped again, so its
+// connections stay in the Tracker the caller gave it.
+func TestGroupKeepsGracefulListener(t *testing.T) {
+	g := NewGroup(NewWithConfig(Config{}))
+	gl := NewTracker().Wrap(listenTCP(t))
+	if err := g.Add(gl, nil); nil != err {
+		t.Fatal(err)
+	}
+	if err := g.Add(listenTCP(t), nil); nil != err {
+		t.Fatal(err)
+	}
+	if gl != g.servers[0].l {
+		t.Error("GracefulListener wrapped again")
+	}
+	if nil == g.servers[1].l {
+		t.Error("plain listener not wrapped")
+	}
+}
@@ -0,0 +1,251 @@
+package goagain
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	claimedMu sync.Mutex
+	claimed   = make(map[string]bool)
+)
+
+// Take over the listener our parent passed for network and addr or, if it
+// didn't pass one, say on first boot or for a socket added since, listen
+// afresh.  The bool reports which happened, so startup code can log
+// accordingly or skip first-boot-only work; Inherited answers the same
+// question later.  Each passed listener is matched by its network and port,
+// and by its IP unless addr leaves the host empty, and is only handed out
+// once.
+func ListenAndInherit(network, addr string) (net.Listener, bool, error) {
+	if l, ok, err := inheritMatching(network, addr); ok {
+		return l, true, err
+	}
+	l, err := net.Listen(network, addr)
+	if nil != err {
+		return nil, false, err
+	}
+	track(l, false)
+	return l, false, nil
+}
+
+// Report whether l was inherited from a parent, or from systemd, rather than
+// bound by this process.  Listeners goagain hasn't seen, because they were
+// neither inherited nor passed to Wait, weren't inherited either.
+func Inherited(l net.Listener) bool {
+	l = unwrap(l)
+	trackedMu.Lock()
+	defer trackedMu.Unlock()
+	for _, t := range tracked {
+		if t.l == l {
+			return t.inherited
+		}
+	}
+	return false
+}
+
+// Claim and reconstruct the passed listener for network and addr, if there is
+// one.
+func inheritMatching(network, addr string) (net.Listener, bool, error) {
+	if _, ok := os.LookupEnv("GOAGAIN_FD"); !ok {
+		return nil, false, nil
+	}
+	var n int
+	if _, err := fmt.Sscan(os.Getenv("GOAGAIN_FD_COUNT"), &n); nil != err {
+		if !claim("", network, addr) {
+			return nil, false, nil
+		}
+		l, err := Listener()
+		return l, true, err
+	}
+	for i := 0; i < n; i++ {
+		if claim(fmt.Sprintf("_%d", i), network, addr) {
+			if err := checkProtocolVersion(); nil != err {
+				return nil, true, err
+			}
+			inheritGOMAXPROCS()
+			l, err := listenerSlot(i)
+			return l, true, err
+		}
+	}
+	return nil, false, nil
+}
+
+// Claim the slot with the given suffix if it's unclaimed and its recorded
+// name matches network and addr.
+func claim(suffix, network, addr string) bool {
+	// A listener's Addr reports tcp whether it was bound as tcp4 or tcp6.
+	switch network {
+	case "tcp4", "tcp6":
+		network = "tcp"
+	}
+	name := strings.TrimSuffix(os.Getenv("GOAGAIN_NAME"+suffix), "->")
+	if !strings.HasPrefix(name, network+":") {
+		return false
+	}
+	if !sameAddr(strings.TrimPrefix(name, network+":"), addr) {
+		return false
+	}
+	return claimSlot(suffix)
+}
+
+// Test whether the address a listener is bound to, have, is what listening
+// on want would have bound, taking an ephemeral port in want to be the one
+// the OS assigned.  Unix socket paths must match exactly.
+func sameAddr(have, want string) bool {
+	if have == want {
+		return true
+	}
+	hHost, hPort, err := net.SplitHostPort(have)
+	if nil != err {
+		return false
+	}
+	wHost, wPort, err := net.SplitHostPort(want)
+	if nil != err || (hPort != wPort && "0" != wPort && "" != wPort) {
+		return false
+	}
+	if "" == wHost {
+		return true
+	}
+	hIP, wIP := net.ParseIP(hHost), net.ParseIP(wHost)
+	return nil != hIP && nil != wIP && hIP.Equal(wIP)
+}
+
+// A listener a process wants, for ListenSet: the name it's handed off under
+// and what to bind if the parent didn't pass it.
+type ListenerSpec struct {
+	Name, Network, Addr string
+}
+
+// Reconcile the listeners our parent passed with the ones we want, for a
+// config change that adds or removes ports across a restart.  A passed
+// listener carrying a spec's name and still on its address is inherited;
+// every other spec is bound afresh.  Any passed listener no spec wants,
+// because its port was removed or moved, is closed first, before anything
+// is bound, so its port is free for another spec and connections aren't
+// left queuing on a socket nobody accepts from.  The parent drains
+// its copies once the handoff is done as usual, so a Group in the parent
+// needn't know what changed.
+//
+// The listeners come back in the order of specs, each tagged with its name
+// so the next restart can match it again.  On error, every listener opened
+// so far is closed.
+func ListenSet(specs []ListenerSpec) (ls []net.Listener, err error) {
+	seen := make(map[string]bool, len(specs))
+	for _, s := range specs {
+		if "" == s.Name || seen[s.Name] {
+			return nil, fmt.Errorf("ListenSet: listener name %q is empty or repeated", s.Name)
+		}
+		seen[s.Name] = true
+	}
+	defer func() {
+		if nil != err {
+			closeListeners(ls)
+			ls = nil
+		}
+	}()
+	slots := passedSlots()
+	if 0 < len(slots) {
+		if err = checkProtocolVersion(); nil != err {
+			return
+		}
+		inheritGOMAXPROCS()
+	}
+	// Close the passed listeners no spec wants before binding anything, so
+	// a port that moved from one of them to another spec is free again.
+	inherit := make(map[string]string, len(specs))
+	wanted := make(map[string]bool, len(slots))
+	for _, s := range specs {
+		if suffix, ok := matchSlot(slots, s); ok {
+			inherit[s.Name], wanted[suffix] = suffix, true
+		}
+	}
+	for _, suffix := range slots {
+		if wanted[suffix] || !claimSlot(suffix) {
+			continue
+		}
+		logln("Closing passed listener", os.Getenv("GOAGAIN_NAME"+suffix), "no longer wanted")
+		if l, err := loadSlot(suffix); nil == err {
+			l.Close()
+		} else {
+			logln("Unable to close unwanted listener:", err)
+		}
+	}
+	for _, s := range specs {
+		var l net.Listener
+		suffix, ok := inherit[s.Name]
+		if ok && claimSlot(suffix) {
+			l, err = loadSlot(suffix)
+		} else if l, err = net.Listen(s.Network, s.Addr); nil == err {
+			track(l, false)
+			l = Named(s.Name, l)
+		}
+		if nil != err {
+			return ls, fmt.Errorf("%s: %w", s.Name, err)
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+// The env suffixes of the listener slots our parent passed: "_0" up for
+// several, "" for a single one, none on first boot.
+func passedSlots() []string {
+	if _, ok := os.LookupEnv("GOAGAIN_FD"); !ok {
+		return nil
+	}
+	var n int
+	if _, err := fmt.Sscan(os.Getenv("GOAGAIN_FD_COUNT"), &n); nil != err {
+		return []string{""}
+	}
+	slots := make([]string, n)
+	for i := range slots {
+		slots[i] = fmt.Sprintf("_%d", i)
+	}
+	return slots
+}
+
+// Find the passed listener named for s, if it's still on s's address.
+func matchSlot(slots []string, s ListenerSpec) (string, bool) {
+	network := s.Network
+	switch network {
+	case "tcp4", "tcp6":
+		network = "tcp"
+	}
+	for _, suffix := range slots {
+		if s.Name != os.Getenv("GOAGAIN_FDNAME"+suffix) {
+			continue
+		}
+		name := strings.TrimSuffix(os.Getenv("GOAGAIN_NAME"+suffix), "->")
+		if !strings.HasPrefix(name, network+":") || !sameAddr(strings.TrimPrefix(name, network+":"), s.Addr) {
+			return "", false
+		}
+		return suffix, true
+	}
+	return "", false
+}
+
+// Mark the slot with the given suffix as handed out, reporting whether it was
+// still free.
+func claimSlot(suffix string) bool {
+	claimedMu.Lock()
+	defer claimedMu.Unlock()
+	if claimed[suffix] {
+		return false
+	}
+	claimed[suffix] = true
+	return true
+}
+
+// Reconstruct the listener in the slot with the given suffix.
+func loadSlot(suffix string) (net.Listener, error) {
+	if "" == suffix {
+		return Listener()
+	}
+	var i int
+	fmt.Sscanf(suffix, "_%d", &i)
+	return listenerSlot(i)
+}
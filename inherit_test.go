@@ -0,0 +1,145 @@
+package goagain
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// Pass ls to ourselves as a parent would to its child, then close the
+// originals as the parent does once it's handed off, leaving only the
+// passed copies.
+func passToSelf(t *testing.T, ls ...net.Listener) {
+	keepEnv(t)
+	claimedMu.Lock()
+	was := claimed
+	claimed = make(map[string]bool)
+	claimedMu.Unlock()
+	t.Cleanup(func() {
+		claimedMu.Lock()
+		claimed = was
+		claimedMu.Unlock()
+	})
+	files, err := handoff{ls: ls}.setEnvs()
+	if nil != err {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { closeFiles(files) })
+	closeListeners(ls)
+}
+
+// Going from two listeners to three: the one kept on its address is
+// inherited, and the one moved onto a dropped listener's port and the one
+// added are bound afresh, the moved one on a port free again since the
+// dropped listener is closed first.
+func TestListenSetChangesPorts(t *testing.T) {
+	api, old := listenTCP(t), listenTCP(t)
+	apiAddr, oldAddr := api.Addr().String(), old.Addr().String()
+	passToSelf(t, Named("api", api), Named("old", old))
+
+	ls, err := ListenSet([]ListenerSpec{
+		{Name: "api", Network: "tcp", Addr: apiAddr},
+		{Name: "new", Network: "tcp", Addr: oldAddr},
+		{Name: "admin", Network: "tcp", Addr: "127.0.0.1:0"},
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer closeListeners(ls)
+	if 3 != len(ls) {
+		t.Fatalf("%d listeners, want 3", len(ls))
+	}
+	for i, want := range []struct {
+		name      string
+		inherited bool
+	}{
+		{"api", true},
+		{"new", false},
+		{"admin", false},
+	} {
+		if got := ListenerName(ls[i]); want.name != got {
+			t.Errorf("listener %d named %q, want %q", i, got, want.name)
+		}
+		if got := Inherited(ls[i]); want.inherited != got {
+			t.Errorf("%s inherited %v, want %v", want.name, got, want.inherited)
+		}
+	}
+	if got := ls[0].Addr().String(); apiAddr != got {
+		t.Errorf("api listener on %s, want %s", got, apiAddr)
+	}
+	if got := ls[1].Addr().String(); oldAddr != got {
+		t.Errorf("new listener on %s, want %s", got, oldAddr)
+	}
+}
+
+// Accept one connection dialed to addr on l.
+func acceptFrom(t *testing.T, l net.Listener, addr string) {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s, err := l.Accept()
+	if nil != err {
+		t.Fatal(err)
+	}
+	s.Close()
+}
+
+// A wildcard tcp listener serving both families is a single fd, and the
+// child's copy still serves both.
+func TestDualStackOneSlot(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	passToSelf(t, l)
+	if "" == os.Getenv("GOAGAIN_FD") || "" != os.Getenv("GOAGAIN_FD_COUNT") {
+		t.Fatalf("GOAGAIN_FD = %q, GOAGAIN_FD_COUNT = %q, want a lone fd",
+			os.Getenv("GOAGAIN_FD"), os.Getenv("GOAGAIN_FD_COUNT"))
+	}
+	ls, err := Listeners()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer closeListeners(ls)
+	if 1 != len(ls) {
+		t.Fatalf("%d listeners, want 1", len(ls))
+	}
+	acceptFrom(t, ls[0], net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if probe, err := net.Listen("tcp6", "[::1]:0"); nil != err {
+		t.Logf("no IPv6 loopback, not dialing it: %v", err)
+	} else {
+		probe.Close()
+		acceptFrom(t, ls[0], net.JoinHostPort("::1", strconv.Itoa(port)))
+	}
+}
+
+// Separate tcp4 and tcp6 sockets on one port are two listeners, and both
+// come back from Listeners.
+func TestSplitStackTwoSlots(t *testing.T) {
+	l4, err := net.Listen("tcp4", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(l4.Addr().(*net.TCPAddr).Port)
+	l6, err := net.Listen("tcp6", net.JoinHostPort("::1", port))
+	if nil != err {
+		l4.Close()
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	passToSelf(t, l4, l6)
+	ls, err := Listeners()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer closeListeners(ls)
+	if 2 != len(ls) {
+		t.Fatalf("%d listeners, want 2", len(ls))
+	}
+	acceptFrom(t, ls[0], net.JoinHostPort("127.0.0.1", port))
+	acceptFrom(t, ls[1], net.JoinHostPort("::1", port))
+}
@@ -0,0 +1,42 @@
+package goagain
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+var (
+	earlyMu sync.Mutex
+	early   = make(map[syscall.Signal]chan os.Signal)
+)
+
+// Catch forkSignal from now on.  Call this first thing in main: until Wait
+// runs there's no handler, so a fork signal sent during a slow startup would
+// otherwise be lost or, with SIGHUP's default disposition, kill the process.
+// A signal caught early is held for Wait, which then restarts immediately.
+func Init(forkSignal syscall.Signal) {
+	earlyMu.Lock()
+	defer earlyMu.Unlock()
+	if _, ok := early[forkSignal]; ok {
+		return
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, forkSignal)
+	early[forkSignal] = ch
+}
+
+// Catch this Handler's fork signal from now on, as Init does.
+func (h *Handler) Init() {
+	s, _ := h.signals()
+	Init(s.fork)
+}
+
+// The channel Init registered for sig, or nil.  It stays registered across
+// Waits so there's never a window without a handler.
+func earlyForkCh(sig syscall.Signal) chan os.Signal {
+	earlyMu.Lock()
+	defer earlyMu.Unlock()
+	return early[sig]
+}
@@ -0,0 +1,13 @@
+package goagain
+
+import "syscall"
+
+// The inode of the socket open on fd, which identifies the kernel socket
+// object whichever process or fd number it's reached through.
+func socketInode(fd uintptr) (uint64, bool, error) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(fd), &st); nil != err {
+		return 0, false, err
+	}
+	return st.Ino, true, nil
+}
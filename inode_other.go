@@ -0,0 +1,8 @@
+//go:build !linux
+
+package goagain
+
+// Socket inodes are only checked on Linux.
+func socketInode(fd uintptr) (uint64, bool, error) {
+	return 0, false, nil
+}
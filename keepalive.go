@@ -0,0 +1,61 @@
+package goagain
+
+import (
+	"net"
+	"os"
+	"time"
+)
+
+// A reconstructed TCP listener that applies the parent's keep-alive setting
+// to each connection it accepts, as a net.ListenConfig would have.
+type keepAliveListener struct {
+	*net.TCPListener
+	period time.Duration
+}
+
+func (l keepAliveListener) Accept() (net.Conn, error) {
+	c, err := l.AcceptTCP()
+	if nil != err {
+		return nil, err
+	}
+	if l.period < 0 {
+		err = c.SetKeepAlive(false)
+	} else if err = c.SetKeepAlive(true); nil == err {
+		err = c.SetKeepAlivePeriod(l.period)
+	}
+	if nil != err {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (l keepAliveListener) Unwrap() net.Listener {
+	return l.TCPListener
+}
+
+func setKeepAlive(opts ForkOptions) error {
+	if 0 == opts.KeepAlive {
+		return unsetenv("GOAGAIN_KEEPALIVE")
+	}
+	return setenv("GOAGAIN_KEEPALIVE", opts.KeepAlive.String())
+}
+
+// Wrap a reconstructed listener so it honors GOAGAIN_KEEPALIVE, if set.  A bad
+// value is logged and leaves Go's default in place.
+func inheritKeepAlive(l net.Listener) net.Listener {
+	s := os.Getenv("GOAGAIN_KEEPALIVE")
+	if "" == s {
+		return l
+	}
+	period, err := time.ParseDuration(s)
+	if nil != err {
+		logln("ignoring bad GOAGAIN_KEEPALIVE", s)
+		return l
+	}
+	tl, ok := l.(*net.TCPListener)
+	if !ok {
+		return l
+	}
+	return keepAliveListener{tl, period}
+}
@@ -0,0 +1,174 @@
+package goagain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// Listen with SO_REUSEADDR set explicitly so a child that must bind afresh
+// rather than inherit, say a replacement binary that can't take the fd, isn't
+// refused while the old socket lingers in TIME_WAIT.  Go already sets this on
+// TCP listeners on most Unix systems; this makes the behavior explicit and
+// independent of that default.  Inheriting the listener is still preferable
+// since a rebind always leaves a moment where neither generation is bound.
+func ListenReuseAddr(network, addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: reuseAddrControl}
+	return lc.Listen(context.Background(), network, addr)
+}
+
+// Listen with SO_REUSEPORT set so another process, the next generation in
+// rebind mode, can bind the same address while this one is still serving.
+// The kernel spreads new connections across every socket bound this way.
+func ListenReusePort(network, addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: reusePortControl}
+	return lc.Listen(context.Background(), network, addr)
+}
+
+// Listen like ListenReusePort but with SO_REUSEPORT_LB on FreeBSD, where
+// plain SO_REUSEPORT doesn't balance and new connections all go to one of the
+// sockets during the overlap.  SO_REUSEPORT_LB spreads them across the
+// generations as Linux's SO_REUSEPORT does.  Both generations must bind this
+// way to share the load, so a child should call this rather than Rebind,
+// which uses plain SO_REUSEPORT.  Elsewhere this is ListenReusePort.
+func ListenReusePortLB(network, addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: reusePortLBControl}
+	return lc.Listen(context.Background(), network, addr)
+}
+
+// Listen with an explicit accept backlog rather than Go's default, which is
+// the system maximum, so a child binding afresh in rebind mode gets the same
+// queue depth the parent was configured with.  An inherited listener keeps
+// its backlog since it's the same socket.  The kernel silently clamps the
+// backlog to net.core.somaxconn on Linux and kern.ipc.somaxconn on the BSDs
+// and macOS.
+func ListenBacklog(network, addr string, backlog int) (net.Listener, error) {
+	l, err := net.Listen(network, addr)
+	if nil != err {
+		return nil, err
+	}
+	var rc syscall.RawConn
+	switch t := l.(type) {
+	case *net.TCPListener:
+		rc, err = t.SyscallConn()
+	case *net.UnixListener:
+		rc, err = t.SyscallConn()
+	default:
+		err = fmt.Errorf("listener is %T not *net.TCPListener or *net.UnixListener", l)
+	}
+	if nil == err {
+		// Calling listen(2) again on a listening socket just sets its backlog.
+		if cErr := rc.Control(func(fd uintptr) {
+			err = retryEINTR(func() error {
+				return syscall.Listen(int(fd), backlog)
+			})
+		}); nil != cErr {
+			err = cErr
+		}
+	}
+	if nil != err {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Returned by Rebind when the address's hostname doesn't resolve and there's
+// no earlier resolution to fall back on.
+var ErrResolveFailed = errors.New("resolving the rebind address failed")
+
+// Bind the address a parent in rebind mode recorded for us, with
+// ListenReusePort.  If a hostname in it no longer resolves, bind the IP the
+// parent last resolved it to instead, so a DNS blip doesn't kill the
+// restart.  Passed listeners never re-resolve so this only matters here.
+func Rebind() (net.Listener, error) {
+	s := os.Getenv("GOAGAIN_REBIND")
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("no rebind address in the environment")
+	}
+	if err := checkProtocolVersion(); nil != err {
+		return nil, err
+	}
+	network, addr := s[:i], s[i+1:]
+	l, err := ListenReusePort(network, addr)
+	var dnsErr *net.DNSError
+	if nil == err {
+		ReportAddr(l.Addr())
+	}
+	if nil == err || !errors.As(err, &dnsErr) {
+		return l, err
+	}
+	if resolved := lastResolved(network, addr); "" != resolved {
+		logln("Unable to resolve", addr, "so binding", resolved, "as last resolved")
+		if l, rErr := ListenReusePort(network, resolved); nil == rErr {
+			ReportAddr(l.Addr())
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %w", ErrResolveFailed, err)
+}
+
+// Record what addr resolves to now in GOAGAIN_NAME, in the form listenerName
+// uses, for Rebind to fall back on.  If it doesn't resolve here either, keep
+// whatever an earlier generation recorded.
+func setRebindName(network, addr string) error {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return unsetenv("GOAGAIN_NAME")
+	}
+	a, err := net.ResolveTCPAddr(network, addr)
+	if nil != err {
+		logln("Unable to resolve", addr, "so keeping the last resolved address:", err)
+		return nil
+	}
+	return setenv("GOAGAIN_NAME", fmt.Sprintf("%s:%s->", network, a))
+}
+
+// The address recorded by setRebindName if it's for the same network and
+// port as addr, or "".
+func lastResolved(network, addr string) string {
+	resolved := strings.TrimSuffix(
+		strings.TrimPrefix(os.Getenv("GOAGAIN_NAME"), network+":"),
+		"->",
+	)
+	_, port, err := net.SplitHostPort(addr)
+	if nil != err {
+		return ""
+	}
+	_, rPort, err := net.SplitHostPort(resolved)
+	if nil != err || port != rPort {
+		return ""
+	}
+	return resolved
+}
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return setsockoptControl(c, soReusePort)
+}
+
+func reusePortLBControl(network, address string, c syscall.RawConn) error {
+	return setsockoptControl(c, soReusePortLB)
+}
+
+func reuseAddrControl(network, address string, c syscall.RawConn) error {
+	return setsockoptControl(c, syscall.SO_REUSEADDR)
+}
+
+// Turn on the SOL_SOCKET option opt on the socket behind c.
+func setsockoptControl(c syscall.RawConn, opt int) error {
+	var err error
+	if cErr := c.Control(func(fd uintptr) {
+		err = retryEINTR(func() error {
+			return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, opt, 1)
+		})
+	}); nil != cErr {
+		return cErr
+	}
+	return err
+}
@@ -0,0 +1,87 @@
+package goagain
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// The value of the integer socket option opt on l's socket.
+func sockopt(t *testing.T, l net.Listener, opt int) int {
+	rc, err := unwrap(l).(syscall.Conn).SyscallConn()
+	if nil != err {
+		t.Fatal(err)
+	}
+	var v int
+	var optErr error
+	if err := rc.Control(func(fd uintptr) {
+		v, optErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, opt)
+	}); nil != err {
+		t.Fatal(err)
+	}
+	if nil != optErr {
+		t.Fatal(optErr)
+	}
+	return v
+}
+
+// SO_REUSEADDR is set, and the address can be bound again straight after a
+// connection on it closes, as a child binding afresh would.
+func TestListenReuseAddr(t *testing.T) {
+	l, err := ListenReuseAddr("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	if 0 == sockopt(t, l, syscall.SO_REUSEADDR) {
+		t.Error("SO_REUSEADDR not set")
+	}
+	c, s := dialAccept(t, l)
+	s.Close()
+	c.Close()
+	l.Close()
+	if l, err = ListenReuseAddr("tcp", addr); nil != err {
+		t.Fatalf("rebinding %s: %v", addr, err)
+	}
+	l.Close()
+}
+
+// A free port on the loopback address.
+func freePort(t *testing.T) string {
+	l := listenTCP(t)
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+	return port
+}
+
+// When the rebind hostname stops resolving, Rebind binds the IP the parent
+// last resolved it to, if it's for the same port.
+func TestRebindFallsBackToLastResolved(t *testing.T) {
+	port := freePort(t)
+	for _, tt := range []struct {
+		name, recorded string
+		want           error
+	}{
+		{"last resolved", "tcp:127.0.0.1:" + port + "->", nil},
+		{"other port", "tcp:127.0.0.1:1->", ErrResolveFailed},
+		{"nothing recorded", "", ErrResolveFailed},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			keepEnv(t)
+			os.Setenv("GOAGAIN_REBIND", "tcp:goagain-test.invalid:"+port)
+			os.Setenv("GOAGAIN_NAME", tt.recorded)
+			l, err := Rebind()
+			if !errors.Is(err, tt.want) || (nil == tt.want) != (nil == err) {
+				t.Fatalf("Rebind: %v, want %v", err, tt.want)
+			}
+			if nil != l {
+				defer l.Close()
+				if got := l.Addr().String(); "127.0.0.1:"+port != got {
+					t.Errorf("bound %s, want 127.0.0.1:%s", got, port)
+				}
+			}
+		})
+	}
+}
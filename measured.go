@@ -0,0 +1,103 @@
+package goagain
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// How many of the latest accepts a MeasuredListener keeps timings for.
+const measuredWindow = 256
+
+// A summary of a MeasuredListener's recent accepts.  Gaps are the time from
+// one accept to the next; a spike around a restart means connections were
+// delayed or went elsewhere during the overlap.
+type AcceptMetrics struct {
+
+	// Every connection accepted since the listener was wrapped.
+	Accepted uint64
+
+	// When the latest connection was accepted, or the zero time.
+	LastAccept time.Time
+
+	// The longest and average gap between consecutive accepts among the
+	// latest ones, and how many gaps that covers.
+	MaxGap, MeanGap time.Duration
+	Gaps            int
+
+	// The longest any one Accept call, among the latest, spent between
+	// being called and returning a connection.
+	MaxWait time.Duration
+}
+
+// A net.Listener that times its accepts, to check that a restart really is
+// zero-downtime.  It costs a mutex and two time.Now calls per connection.
+type MeasuredListener struct {
+	net.Listener
+
+	mu       sync.Mutex
+	accepted uint64
+	last     time.Time
+	gaps     [measuredWindow]time.Duration
+	waits    [measuredWindow]time.Duration
+	n        int
+}
+
+// Wrap l to time its accepts.  The result may be passed to Wait in place of
+// l.
+func NewMeasuredListener(l net.Listener) *MeasuredListener {
+	return &MeasuredListener{Listener: l}
+}
+
+// Accept a connection, recording how long it took and how long it's been
+// since the last one.
+func (l *MeasuredListener) Accept() (net.Conn, error) {
+	start := time.Now()
+	c, err := l.Listener.Accept()
+	if nil != err {
+		return nil, err
+	}
+	now := time.Now()
+	l.mu.Lock()
+	i := int(l.accepted % measuredWindow)
+	l.waits[i] = now.Sub(start)
+	if !l.last.IsZero() {
+		l.gaps[i] = now.Sub(l.last)
+		if l.n < measuredWindow {
+			l.n++
+		}
+	}
+	l.accepted++
+	l.last = now
+	l.mu.Unlock()
+	return c, nil
+}
+
+// Summarize the latest accepts.
+func (l *MeasuredListener) AcceptStats() AcceptMetrics {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	m := AcceptMetrics{
+		Accepted:   l.accepted,
+		LastAccept: l.last,
+		Gaps:       l.n,
+	}
+	var total time.Duration
+	for i := 0; i < measuredWindow && uint64(i) < l.accepted; i++ {
+		if l.waits[i] > m.MaxWait {
+			m.MaxWait = l.waits[i]
+		}
+		total += l.gaps[i]
+		if l.gaps[i] > m.MaxGap {
+			m.MaxGap = l.gaps[i]
+		}
+	}
+	if 0 < l.n {
+		m.MeanGap = total / time.Duration(l.n)
+	}
+	return m
+}
+
+func (l *MeasuredListener) Unwrap() net.Listener {
+	return l.Listener
+}
@@ -0,0 +1,43 @@
+package goagain
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Block until forkSignal and migrate to newNetwork and newAddr.  This is
+// NewWithConfig(...).MigrateListener(oldL, newNetwork, newAddr).
+func MigrateListener(oldL net.Listener, newNetwork, newAddr string, forkSignal syscall.Signal, quitSignal syscall.Signal, timeout time.Duration) error {
+	return NewWithConfig(Config{
+		ForkSignal: forkSignal,
+		QuitSignal: quitSignal,
+		Timeout:    timeout,
+	}).MigrateListener(oldL, newNetwork, newAddr)
+}
+
+// Restart onto a different address, say when the configured port changes.
+// An inherited socket can't change its address so this doesn't pass oldL at
+// all: the child binds newNetwork and newAddr fresh, via Rebind, and sends
+// the quit signal once it's accepting there.  The two addresses overlap
+// until this returns, after which the caller stops accepting on oldL and
+// drains its connections as after Wait.  Moving clients over, with DNS or a
+// load balancer, is up to the caller.
+func (h *Handler) MigrateListener(oldL net.Listener, newNetwork, newAddr string) error {
+	if err := Validate(oldL); nil != err {
+		return err
+	}
+	if 0 < h.cfg.StandbyDuration {
+		return errors.New("StandbyDuration can't pause a listener on another address")
+	}
+	if 0 != h.cfg.CutoverSignal {
+		return errors.New("CutoverSignal can't stop a listener on another address")
+	}
+	if a := oldL.Addr(); a.Network() == newNetwork && a.String() == newAddr {
+		return errors.New("MigrateListener to the same address; use Wait")
+	}
+	track(oldL, false)
+	return h.wait(context.Background(), handoff{network: newNetwork, addr: newAddr})
+}
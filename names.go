@@ -0,0 +1,99 @@
+package goagain
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// A listener tagged with a logical name that travels with it across
+// restarts.
+type namedListener struct {
+	net.Listener
+	name string
+}
+
+func (l *namedListener) Unwrap() net.Listener {
+	return l.Listener
+}
+
+// Tag l with a logical name, such as "http" or "admin", recorded next to its
+// fd so the child can route each inherited socket to the right server with
+// ListenerByName rather than relying on the order listeners were passed in.
+// Names must be unique among the listeners handed off together.
+func Named(name string, l net.Listener) net.Listener {
+	return &namedListener{Listener: l, name: name}
+}
+
+// The name given to l with Named, or inherited with it, or "".
+func ListenerName(l net.Listener) string {
+	for {
+		if n, ok := l.(*namedListener); ok {
+			return n.name
+		}
+		u, ok := l.(interface {
+			Unwrap() net.Listener
+		})
+		if !ok {
+			return ""
+		}
+		next := u.Unwrap()
+		if nil == next || next == l {
+			return ""
+		}
+		l = next
+	}
+}
+
+// Refuse to hand off two listeners with the same name, which the child
+// couldn't tell apart.
+func checkNames(ls []net.Listener) error {
+	seen := make(map[string]bool, len(ls))
+	for _, l := range ls {
+		name := ListenerName(l)
+		if "" == name {
+			continue
+		}
+		if seen[name] {
+			return fmt.Errorf("more than one listener named %q", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// Wrap an inherited listener in the name its parent recorded, if any.
+func inheritName(l net.Listener, name string) net.Listener {
+	if "" == name {
+		return l
+	}
+	return Named(name, l)
+}
+
+// Find the listener a goagain parent passed under name.  The bool reports
+// whether a goagain parent passed any listeners at all, in which case
+// systemd's LISTEN_FDNAMES can't apply.
+func nativeListenerByName(name string) (net.Listener, bool, error) {
+	if _, ok := os.LookupEnv("GOAGAIN_FD"); !ok {
+		return nil, false, nil
+	}
+	var n int
+	if _, err := fmt.Sscan(os.Getenv("GOAGAIN_FD_COUNT"), &n); nil != err {
+		if name != os.Getenv("GOAGAIN_FDNAME") {
+			return nil, true, fmt.Errorf("no listener named %q passed by the parent", name)
+		}
+		l, err := Listener()
+		return l, true, err
+	}
+	for i := 0; i < n; i++ {
+		if name == os.Getenv(fmt.Sprintf("GOAGAIN_FDNAME_%d", i)) {
+			if err := checkProtocolVersion(); nil != err {
+				return nil, true, err
+			}
+			inheritGOMAXPROCS()
+			l, err := listenerSlot(i)
+			return l, true, err
+		}
+	}
+	return nil, true, fmt.Errorf("no listener named %q passed by the parent", name)
+}
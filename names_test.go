@@ -0,0 +1,71 @@
+package goagain
+
+import (
+	"net"
+	"testing"
+)
+
+func TestListenerName(t *testing.T) {
+	l := listenTCP(t)
+	for _, tt := range []struct {
+		name string
+		l    net.Listener
+		want string
+	}{
+		{"named", Named("http", l), "http"},
+		{"wrapped", NewGracefulListener(wrappedListener{Named("http", l)}), "http"},
+		{"renamed", Named("outer", Named("inner", l)), "outer"},
+		{"unnamed", NewGracefulListener(l), ""},
+		{"self-unwrapping", &loopListener{l}, ""},
+	} {
+		if got := ListenerName(tt.l); tt.want != got {
+			t.Errorf("%s: ListenerName = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	if err := checkNames([]net.Listener{Named("a", l), l, Named("a", l)}); nil == err {
+		t.Error("two listeners named a handed off together")
+	}
+	if err := checkNames([]net.Listener{Named("a", l), l, l, Named("b", l)}); nil != err {
+		t.Error(err)
+	}
+}
+
+// Names travel with the listeners, several or one, and find them in the
+// child whatever order they were passed in.
+func TestListenerByName(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		names []string
+	}{
+		{"several", []string{"http", "admin"}},
+		{"single", []string{"http"}},
+	} {
+		names := tt.names
+		t.Run(tt.name, func(t *testing.T) {
+			addrs := make(map[string]string)
+			var ls []net.Listener
+			for _, name := range names {
+				l := listenTCP(t)
+				addrs[name] = l.Addr().String()
+				ls = append(ls, Named(name, l))
+			}
+			passToSelf(t, ls...)
+			for i := len(names) - 1; i >= 0; i-- {
+				l, err := ListenerByName(names[i])
+				if nil != err {
+					t.Fatal(err)
+				}
+				defer l.Close()
+				if got := l.Addr().String(); addrs[names[i]] != got {
+					t.Errorf("%s on %s, want %s", names[i], got, addrs[names[i]])
+				}
+				if got := ListenerName(l); names[i] != got {
+					t.Errorf("%s inherited as %q", names[i], got)
+				}
+			}
+			if _, err := ListenerByName("metrics"); nil == err {
+				t.Error("found a listener nobody passed")
+			}
+		})
+	}
+}
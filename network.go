@@ -0,0 +1,74 @@
+package goagain
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+)
+
+var (
+	networksMu sync.RWMutex
+	networks   = make(map[string]func(*os.File) (net.Listener, error))
+)
+
+// Teach goagain to pass listeners whose Addr().Network() is network, some
+// transport the net package can't reconstruct, such as vsock or AF_PACKET.
+// In the parent, such a listener, or the one it unwraps to, must have a
+// File() (*os.File, error) method as *net.TCPListener does, returning a dup
+// of its fd.  In the child, fn rebuilds the listener from that fd.  As with
+// net.FileListener, the file is closed once fn returns, so fn must dup it if
+// it keeps the fd.  Register the network in both generations, say from an
+// init function.  Both sides record and check the same network string, so a
+// child that hasn't registered it refuses the fd and doesn't guess.
+//
+// The fd isn't checked beyond its inode, since a custom transport's socket
+// type, or whether it's a socket at all, is its own business.
+// StandbyDuration and CutoverSignal stop Accept with a deadline, so Wait
+// refuses such a listener with either set unless it also has a
+// SetDeadline(time.Time) error method.  Registering a network the net
+// package handles, or registering one twice, panics.
+func RegisterNetwork(network string, fn func(*os.File) (net.Listener, error)) {
+	if nil == fn {
+		panic("goagain: RegisterNetwork fn is nil")
+	}
+	if _, ok := networkSocketTypes[network]; ok || "" == network {
+		panic(fmt.Sprintf("goagain: RegisterNetwork of built-in network %q", network))
+	}
+	networksMu.Lock()
+	defer networksMu.Unlock()
+	if _, dup := networks[network]; dup {
+		panic(fmt.Sprintf("goagain: RegisterNetwork called twice for %q", network))
+	}
+	networks[network] = fn
+}
+
+// The reconstruction function registered for network, if any.
+func registeredNetwork(network string) func(*os.File) (net.Listener, error) {
+	networksMu.RLock()
+	defer networksMu.RUnlock()
+	return networks[network]
+}
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// l's File method if l is on a registered network and has one.
+func customFiler(l net.Listener) (filer, bool) {
+	if nil == registeredNetwork(l.Addr().Network()) {
+		return nil, false
+	}
+	fl, ok := l.(filer)
+	return fl, ok
+}
+
+// The dup of l's fd to pass if l is on a registered network.
+func customListenerFile(l net.Listener) (f *os.File, ok bool, err error) {
+	fl, ok := customFiler(l)
+	if !ok {
+		return nil, false, nil
+	}
+	f, err = aboveStdio(fl.File())
+	return f, true, err
+}
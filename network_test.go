@@ -0,0 +1,143 @@
+package goagain
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// A made-up transport: a Unix socket whose Addr reports network "testnet".
+type testnetListener struct{ *net.UnixListener }
+
+func (l testnetListener) Addr() net.Addr {
+	return testnetAddr(l.UnixListener.Addr().String())
+}
+
+type testnetAddr string
+
+func (a testnetAddr) Network() string { return "testnet" }
+func (a testnetAddr) String() string  { return string(a) }
+
+func testnetFromFile(f *os.File) (net.Listener, error) {
+	l, err := net.FileListener(f)
+	if nil != err {
+		return nil, err
+	}
+	return testnetListener{l.(*net.UnixListener)}, nil
+}
+
+// Register network for the rest of the test only.
+func registerForTest(t *testing.T, network string, fn func(*os.File) (net.Listener, error)) {
+	RegisterNetwork(network, fn)
+	t.Cleanup(func() { unregisterNetwork(network) })
+}
+
+func unregisterNetwork(network string) {
+	networksMu.Lock()
+	delete(networks, network)
+	networksMu.Unlock()
+}
+
+func TestRegisterNetworkPanics(t *testing.T) {
+	registerForTest(t, "testnet", testnetFromFile)
+	for _, tt := range []struct {
+		name    string
+		network string
+		fn      func(*os.File) (net.Listener, error)
+	}{
+		{"nil fn", "othernet", nil},
+		{"built-in", "tcp", testnetFromFile},
+		{"empty", "", testnetFromFile},
+		{"twice", "testnet", testnetFromFile},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if nil == recover() {
+					t.Error("RegisterNetwork didn't panic")
+				}
+			}()
+			RegisterNetwork(tt.network, tt.fn)
+		})
+	}
+}
+
+// Pass a testnet listener to ourselves, returning the path it listens on.
+func passTestnet(t *testing.T) string {
+	registerForTest(t, "testnet", testnetFromFile)
+	ul := listenUnix(t).(*net.UnixListener)
+	ul.SetUnlinkOnClose(false)
+	l := testnetListener{ul}
+	if err := Validate(l); nil != err {
+		t.Fatalf("Validate: %v", err)
+	}
+	passToSelf(t, l)
+	return l.UnixListener.Addr().String()
+}
+
+// A listener on a registered network goes through fn in the child.
+func TestRegisteredNetworkRoundTrip(t *testing.T) {
+	addr := passTestnet(t)
+	l, err := Listener()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if _, ok := l.(testnetListener); !ok {
+		t.Fatalf("got %T, want testnetListener", l)
+	}
+	c, err := net.Dial("unix", addr)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s, err := l.Accept()
+	if nil != err {
+		t.Fatal(err)
+	}
+	s.Close()
+}
+
+// A child that hasn't registered the network refuses the fd.
+func TestUnregisteredNetworkRefused(t *testing.T) {
+	passTestnet(t)
+	unregisterNetwork("testnet")
+	if l, err := Listener(); nil == err {
+		l.Close()
+		t.Fatal("listener on an unregistered network was reconstructed")
+	}
+}
+
+// A testnet listener with File but no SetDeadline.
+type bareListener struct{ ul *net.UnixListener }
+
+func (l bareListener) Accept() (net.Conn, error) { return l.ul.Accept() }
+func (l bareListener) Close() error              { return l.ul.Close() }
+func (l bareListener) Addr() net.Addr            { return testnetAddr(l.ul.Addr().String()) }
+func (l bareListener) File() (*os.File, error)   { return l.ul.File() }
+
+// A listener on a custom transport without SetDeadline passes Validate, but
+// a Wait whose ForkOptions would need to stop it refuses it up front, and
+// setDeadlines returns an error instead of panicking.
+func TestStopWithoutSetDeadline(t *testing.T) {
+	registerForTest(t, "testnet", testnetFromFile)
+	l := bareListener{listenUnix(t).(*net.UnixListener)}
+	if err := Validate(l); nil != err {
+		t.Fatalf("Validate: %v", err)
+	}
+	if err := setDeadlines([]net.Listener{l}, time.Now()); nil == err {
+		t.Error("setDeadlines stopped a listener without SetDeadline")
+	}
+	for _, opts := range []ForkOptions{
+		{StandbyDuration: time.Second},
+		{CutoverSignal: syscall.SIGUSR2},
+	} {
+		if err := NewWithConfig(Config{ForkOptions: opts}).Wait(l); nil == err {
+			t.Errorf("Wait with %+v accepted a listener without SetDeadline", opts)
+		}
+	}
+	if err := (ForkOptions{}).checkStoppable([]net.Listener{l}); nil != err {
+		t.Errorf("checkStoppable without standby or cutover: %v", err)
+	}
+}
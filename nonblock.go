@@ -0,0 +1,44 @@
+package goagain
+
+import (
+	"os"
+	"syscall"
+)
+
+// f's fd number, or ^uintptr(0) if f is closed.  Unlike f.Fd(), this leaves
+// the fd's mode alone.  Fd puts it in blocking mode, and O_NONBLOCK belongs
+// to the open file description, which a dup shares with the listener or
+// connection it was made from.
+func sysfd(f *os.File) uintptr {
+	fd := ^uintptr(0)
+	if rc, err := f.SyscallConn(); nil == err {
+		rc.Control(func(s uintptr) { fd = s })
+	}
+	return fd
+}
+
+// The fds among files in nonblocking mode, to put back with restore.
+type nonblocking []uintptr
+
+// Note which of files are in nonblocking mode before os.StartProcess, which
+// calls Fd on each, puts them all in blocking mode.
+func nonblockingFds(files []*os.File) nonblocking {
+	var nb nonblocking
+	for _, f := range files {
+		fd := sysfd(f)
+		flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_GETFL, 0)
+		if 0 == errno && 0 != flags&syscall.O_NONBLOCK {
+			nb = append(nb, fd)
+		}
+	}
+	return nb
+}
+
+// Put nb's fds back in nonblocking mode.
+func (nb nonblocking) restore() {
+	for _, fd := range nb {
+		if err := syscall.SetNonblock(int(fd), true); nil != err {
+			logln("restoring nonblocking mode on fd", fd, "failed:", err)
+		}
+	}
+}
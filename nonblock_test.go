@@ -0,0 +1,82 @@
+package goagain
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Whether the socket behind c is in nonblocking mode.
+func isNonblocking(t *testing.T, c syscall.Conn) bool {
+	t.Helper()
+	rc, err := c.SyscallConn()
+	if nil != err {
+		t.Fatal(err)
+	}
+	var flags uintptr
+	var errno syscall.Errno
+	rc.Control(func(fd uintptr) {
+		flags, _, errno = syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_GETFL, 0)
+	})
+	if 0 != errno {
+		t.Fatal(errno)
+	}
+	return 0 != flags&syscall.O_NONBLOCK
+}
+
+// Recording the slots reads each dup's fd number without putting the
+// socket, which the listener shares, in blocking mode.
+func TestSetEnvsKeepsNonblocking(t *testing.T) {
+	keepEnv(t)
+	ls := []net.Listener{listenTCP(t), listenUnix(t)}
+	files, err := handoff{ls: ls}.setEnvs()
+	if nil != err {
+		t.Fatal(err)
+	}
+	closeFiles(files)
+	for _, l := range ls {
+		if !isNonblocking(t, unwrap(l).(syscall.Conn)) {
+			t.Errorf("%s listener left in blocking mode", l.Addr().Network())
+		}
+	}
+}
+
+// The fd a custom event loop polls is still nonblocking once WaitRaw has
+// forked a child with it.
+func TestWaitRawKeepsNonblocking(t *testing.T) {
+	keepEnv(t)
+	standIn(t, "sleep", syscall.SIGQUIT)
+	l := listenTCP(t).(*net.TCPListener)
+	rc, err := l.SyscallConn()
+	if nil != err {
+		t.Fatal(err)
+	}
+	var fd uintptr
+	rc.Control(func(s uintptr) { fd = s })
+	if err := SetRawFd(fd, "raw"); nil != err {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		rawMu.Lock()
+		rawSet = nil
+		rawMu.Unlock()
+	})
+
+	h := NewWithConfig(Config{ForkSignal: syscall.SIGUSR1, Timeout: 5 * time.Second})
+	h.Init()
+	defer Cleanup()
+	syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+	err = h.WaitRaw()
+	if pid := h.LastResult().NewPid; 0 != pid {
+		defer waitGone(t, pid)
+		defer syscall.Kill(pid, syscall.SIGKILL)
+	}
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !isNonblocking(t, l) {
+		t.Error("raw fd left in blocking mode by the fork")
+	}
+}
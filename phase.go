@@ -0,0 +1,60 @@
+package goagain
+
+import "time"
+
+// A step in a restart, reported to Config.OnPhase so it can be traced, say as
+// one span per phase under a span for the whole restart.
+type Phase string
+
+const (
+	PhaseRestart  Phase = "restart"  // everything after the fork signal
+	PhaseFork     Phase = "fork"     // spawning the child
+	PhaseReady    Phase = "ready"    // waiting for the child's quit signal
+	PhaseVerify   Phase = "verify"   // running Config.Verify
+	PhaseCompat   Phase = "compat"   // running Config.CompatCheck
+	PhaseExternal Phase = "external" // polling Config.ExternalReady
+	PhaseStandby  Phase = "standby"  // ForkOptions.StandbyDuration
+)
+
+// The start or end of a Phase.
+type PhaseEvent struct {
+	Phase Phase
+
+	// False when the phase starts, true when it ends.
+	End bool
+
+	// The child's pid, once there is one.
+	Pid int
+
+	// At the end, how long the phase took and how it failed, if it did.
+	Duration time.Duration
+	Err      error
+
+	// At the end of PhaseFork, how the child was exec'd, once its argv has
+	// been resolved.
+	Exec *ExecInfo
+}
+
+// Run f as phase p, reporting its start and end to Config.OnPhase.  pid is
+// read at each report so f may fill it in, and each of detail gets to add to
+// the end report.
+func (h *Handler) phase(p Phase, pid *int, f func() error, detail ...func(*PhaseEvent)) error {
+	if nil == h.cfg.OnPhase {
+		return f()
+	}
+	start := time.Now()
+	h.cfg.OnPhase(PhaseEvent{Phase: p, Pid: *pid})
+	err := f()
+	ev := PhaseEvent{
+		Phase:    p,
+		End:      true,
+		Pid:      *pid,
+		Duration: time.Since(start),
+		Err:      err,
+	}
+	for _, d := range detail {
+		d(&ev)
+	}
+	h.cfg.OnPhase(ev)
+	return err
+}
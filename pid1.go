@@ -0,0 +1,64 @@
+package goagain
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+var (
+	warnInitOnce sync.Once
+
+	heldMu   sync.Mutex
+	held     = make(map[syscall.Signal]bool)
+	heldSink chan os.Signal
+)
+
+// Whether we're PID 1, the init process of a PID namespace, as a container's
+// entrypoint usually is.
+func isInit() bool {
+	return 1 == os.Getpid()
+}
+
+// As PID 1 the kernel discards any signal whose disposition is the default,
+// so a fork signal before Wait or a child's quit signal after signal.Stop
+// would vanish without a trace.  Keep a handler for each of the Handler's
+// signals for the life of the process: the fork signal is caught as Init
+// does so an early one is held for Wait, the rest are discarded outside a
+// restart, during which Wait has channels of its own for them.
+func (h *Handler) holdSignals() {
+	if !isInit() {
+		return
+	}
+	warnInitOnce.Do(func() {
+		logln("Running as PID 1: when this process exits after a handoff, the kernel kills every other process in the PID namespace, the new child included; run under an init such as tini or docker run --init")
+	})
+	s, _ := h.signals()
+	Init(s.fork)
+	for _, sig := range []syscall.Signal{s.quit, s.ready, s.abort, h.cfg.CutoverSignal} {
+		if 0 != sig {
+			holdSignal(sig)
+		}
+	}
+}
+
+// Discard sig from now on, unless a Wait has a channel of its own for it.
+// Every Handler holding sig shares one registration, as Init's are shared,
+// so making Handlers or changing their signals doesn't pile them up.
+func holdSignal(sig syscall.Signal) {
+	heldMu.Lock()
+	defer heldMu.Unlock()
+	if held[sig] {
+		return
+	}
+	if nil == heldSink {
+		heldSink = make(chan os.Signal, 1)
+		go func() {
+			for range heldSink {
+			}
+		}()
+	}
+	signal.Notify(heldSink, sig)
+	held[sig] = true
+}
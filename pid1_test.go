@@ -0,0 +1,27 @@
+package goagain
+
+import (
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+// Holding the same signals again, as every NewWithConfig and SetSignals
+// does as PID 1, starts nothing new.
+func TestHoldSignalOnce(t *testing.T) {
+	holdSignal(syscall.SIGUSR1)
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		holdSignal(syscall.SIGUSR1)
+		holdSignal(syscall.SIGUSR2)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("%d goroutines after holding signals again, %d before", after, before)
+	}
+	heldMu.Lock()
+	n := len(held)
+	heldMu.Unlock()
+	if 2 != n {
+		t.Errorf("%d signals held, want 2", n)
+	}
+}
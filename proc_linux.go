@@ -0,0 +1,89 @@
+package goagain
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The start time of process pid in clock ticks since boot, from
+// /proc/<pid>/stat, which together with the pid identifies a process even
+// after the pid is recycled.
+func procStartTime(pid int) (uint64, error) {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if nil != err {
+		return 0, err
+	}
+	// The command name is in parentheses and may itself contain spaces or
+	// parentheses, so count fields from the last one.
+	s := string(b)
+	fields := strings.Fields(s[strings.LastIndex(s, ")")+1:])
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("/proc/%d/stat: too few fields", pid)
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// List the other processes that have any of the listeners ListenerDiagnostics
+// reports open, as during the overlap of a restart, by matching socket
+// inodes under /proc/*/fd.  Only processes we may inspect, normally our own
+// user's, are seen.  A process whose start time changes during the scan
+// exited and had its pid reused, so it's left out rather than misreported.
+func SharingProcesses() ([]int, error) {
+	inodes := make(map[string]bool)
+	for _, d := range ListenerDiagnostics() {
+		if d.Fd < 0 {
+			continue
+		}
+		link, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", d.Fd))
+		if nil != err {
+			return nil, err
+		}
+		inodes[link] = true
+	}
+	if 0 == len(inodes) {
+		return nil, nil
+	}
+	dirs, err := filepath.Glob("/proc/[0-9]*")
+	if nil != err {
+		return nil, err
+	}
+	var pids []int
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(filepath.Base(dir))
+		if nil != err || pid == syscall.Getpid() {
+			continue
+		}
+		start, err := procStartTime(pid)
+		if nil != err {
+			continue
+		}
+		if !holdsSocket(dir, inodes) {
+			continue
+		}
+		if again, err := procStartTime(pid); nil != err || again != start {
+			continue
+		}
+		pids = append(pids, pid)
+	}
+	return pids, nil
+}
+
+// Test whether the process at /proc/<pid> dir has an fd open on any of the
+// sockets, given as their "socket:[inode]" links.
+func holdsSocket(dir string, inodes map[string]bool) bool {
+	fds, err := os.ReadDir(filepath.Join(dir, "fd"))
+	if nil != err {
+		return false
+	}
+	for _, fd := range fds {
+		link, err := os.Readlink(filepath.Join(dir, "fd", fd.Name()))
+		if nil == err && inodes[link] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package goagain
+
+import "errors"
+
+// Process start times need /proc; elsewhere ancestors go unverified, so
+// none count as alive.
+func procStartTime(pid int) (uint64, error) {
+	return 0, errors.New("process start times are only supported on Linux")
+}
+
+// Finding which processes share a socket needs /proc.
+func SharingProcesses() ([]int, error) {
+	return nil, errors.New("SharingProcesses is only supported on Linux")
+}
@@ -0,0 +1,58 @@
+package goagain
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Catch the fork signal from startup if our parent may forward us a queued
+// restart, so it's held for Wait rather than lost or, with SIGHUP, fatal.
+func init() {
+	var sig int
+	if _, err := fmt.Sscan(os.Getenv("GOAGAIN_QUEUE_SIGNAL"), &sig); nil == err && 0 < sig {
+		Init(syscall.Signal(sig))
+	}
+}
+
+func setQueueSignal(opts ForkOptions) error {
+	if 0 == opts.queueSignal {
+		return unsetenv("GOAGAIN_QUEUE_SIGNAL")
+	}
+	return setenv("GOAGAIN_QUEUE_SIGNAL", fmt.Sprint(int(opts.queueSignal)))
+}
+
+// Watch forkCh for the length of a restart, queueing one more for any fork
+// signal.  The returned function stops watching and reports whether a
+// restart was queued, clearing it.
+func (h *Handler) queueForks(forkCh <-chan os.Signal) func() bool {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-forkCh:
+				logln("Fork signal during restart, queueing another.")
+				h.queued.Store(true)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() bool {
+		close(done)
+		<-stopped
+		return h.queued.Swap(false)
+	}
+}
+
+// Hand a restart queued during the one that just succeeded to the child
+// that's taken over.
+func (h *Handler) passQueued(fork syscall.Signal) {
+	pid := h.LastResult().NewPid
+	logln("Passing the queued restart to child", pid)
+	if err := killRetryEINTR(pid, fork); nil != err {
+		logln("Unable to pass the queued restart to child", pid, err)
+	}
+}
@@ -0,0 +1,110 @@
+package goagain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A file descriptor passed as is, without a net.Listener around it.
+type rawFd struct {
+	fd   uintptr
+	name string
+}
+
+var (
+	rawMu  sync.Mutex
+	rawSet *rawFd
+)
+
+// Mark fd, say a listening socket a custom epoll or kqueue event loop polls
+// directly, to be passed to the next child under name by WaitRaw.  The child
+// gets it back with RawFd.
+//
+// goagain never wraps the fd in a net.Listener in this mode, so the caller is
+// responsible for all of its socket semantics: nonblocking mode, keepalives,
+// re-registering it with the child's event loop and unlinking a Unix
+// socket's path.  None of the socket type, inode or name checks apply.
+func SetRawFd(fd uintptr, name string) error {
+	if err := fdOpen(fd); nil != err {
+		return fmt.Errorf("SetRawFd %d: %w", fd, err)
+	}
+	rawMu.Lock()
+	rawSet = &rawFd{fd, name}
+	rawMu.Unlock()
+	return nil
+}
+
+// The fd and name the parent passed with SetRawFd, for the child to hand to
+// its own event loop.  Unlike Listener this takes the fd as it is.
+func RawFd() (fd uintptr, name string, err error) {
+	if err = checkProtocolVersion(); nil != err {
+		return
+	}
+	inheritGOMAXPROCS()
+	if _, err = fmt.Sscan(os.Getenv("GOAGAIN_FD"), &fd); nil != err {
+		return
+	}
+	name = os.Getenv("GOAGAIN_NAME")
+	return
+}
+
+// Block until forkSignal, fork a child that inherits the fd marked by
+// SetRawFd and wait for it to send quitSignal.  This is
+// NewWithConfig(...).WaitRaw().
+func WaitRaw(forkSignal syscall.Signal, quitSignal syscall.Signal, timeout time.Duration) error {
+	return NewWithConfig(Config{
+		ForkSignal: forkSignal,
+		QuitSignal: quitSignal,
+		Timeout:    timeout,
+	}).WaitRaw()
+}
+
+// Restart like Wait but pass the fd marked by SetRawFd rather than a
+// listener.  Afterwards the caller stops polling the fd and closes it.
+func (h *Handler) WaitRaw() error {
+	rawMu.Lock()
+	r := rawSet
+	rawMu.Unlock()
+	if nil == r {
+		return errors.New("WaitRaw needs SetRawFd first")
+	}
+	if 0 < h.cfg.StandbyDuration {
+		return errors.New("StandbyDuration needs a listener to pause")
+	}
+	if 0 != h.cfg.CutoverSignal {
+		return errors.New("CutoverSignal needs a listener to stop")
+	}
+	return h.wait(context.Background(), handoff{raw: r})
+}
+
+// Record r alone as GOAGAIN_FD and GOAGAIN_NAME, returning the dup to pass.
+func (r *rawFd) setEnvs() ([]*os.File, error) {
+	for _, key := range []string{"GOAGAIN_REBIND", "GOAGAIN_NET", "GOAGAIN_FDNAME", "GOAGAIN_INODE"} {
+		if err := unsetenv(key); nil != err {
+			return nil, err
+		}
+	}
+	fd, err := syscall.Dup(int(r.fd))
+	if nil != err {
+		return nil, err
+	}
+	syscall.CloseOnExec(fd)
+	f, err := aboveStdio(os.NewFile(uintptr(fd), r.name), nil)
+	if nil != err {
+		return nil, err
+	}
+	if err := setenv("GOAGAIN_FD", fmt.Sprint(sysfd(f))); nil != err {
+		f.Close()
+		return nil, err
+	}
+	if err := setenv("GOAGAIN_NAME", r.name); nil != err {
+		f.Close()
+		return nil, err
+	}
+	return []*os.File{f}, nil
+}
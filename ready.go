@@ -0,0 +1,47 @@
+package goagain
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// A preflight check SignalReady runs before telling the parent anything, the
+// place for a child to validate its config and whatever else would have it
+// serving errors once in charge.  If it fails the child signals abort instead
+// and exits, leaving the old generation serving.
+var ValidateChild func() error
+
+// Tell our parent we've taken over: send it the ForkOptions.ReadySignal it
+// recorded or, failing that, SIGQUIT, the default Config.QuitSignal.  Call
+// this once accepting, in place of Kill(syscall.SIGQUIT).  ValidateChild, if
+// set, runs first and on failure this doesn't return.
+func SignalReady() error {
+	if nil != ValidateChild {
+		if err := ValidateChild(); nil != err {
+			logln("Child failed validation, aborting the restart:", err)
+			if aErr := SignalAbort(); nil != aErr {
+				logln("Unable to signal abort:", aErr)
+			}
+			os.Exit(1)
+		}
+	}
+	return Kill(readySignal(syscall.SIGQUIT))
+}
+
+// The signal the parent is waiting for to confirm we're ready: the one it
+// recorded in GOAGAIN_READY_SIGNAL, else fallback.
+func readySignal(fallback syscall.Signal) syscall.Signal {
+	var sig int
+	if _, err := fmt.Sscan(os.Getenv("GOAGAIN_READY_SIGNAL"), &sig); nil != err {
+		return fallback
+	}
+	return syscall.Signal(sig)
+}
+
+func setReadySignal(opts ForkOptions) error {
+	if 0 == opts.ReadySignal {
+		return unsetenv("GOAGAIN_READY_SIGNAL")
+	}
+	return setenv("GOAGAIN_READY_SIGNAL", fmt.Sprint(int(opts.ReadySignal)))
+}
@@ -0,0 +1,105 @@
+package goagain
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long the parent waits for a ready child's address to arrive.  The child
+// writes it before sending the quit signal so it's normally already there.
+const addrReportWait = 100 * time.Millisecond
+
+// The pipe a child reports the address it bound through, in rebind mode or
+// for Config.CompatCheck.  The child inherits w; the parent reads r once the
+// child is ready.
+type addrReport struct {
+	r, w *os.File
+}
+
+func newAddrReport() (*addrReport, error) {
+	r, w, err := os.Pipe()
+	if nil != err {
+		return nil, err
+	}
+	if w, err = aboveStdio(w, nil); nil != err {
+		r.Close()
+		return nil, err
+	}
+	return &addrReport{r: r, w: w}, nil
+}
+
+func (a *addrReport) close() {
+	a.r.Close()
+	a.w.Close()
+}
+
+// The address the child reported, or nil if it reported none.
+func (a *addrReport) read() net.Addr {
+	a.w.Close()
+	a.r.SetReadDeadline(time.Now().Add(addrReportWait))
+	b, _ := io.ReadAll(a.r)
+	network, addr, ok := strings.Cut(strings.TrimSpace(string(b)), " ")
+	if !ok {
+		return nil
+	}
+	return reportedAddr{network, addr}
+}
+
+// Record the report pipe's fd for the child, or clear one we inherited.
+func (t handoff) setAddrReportEnv() error {
+	if nil == t.report {
+		return unsetenv("GOAGAIN_ADDR_FD")
+	}
+	return setenv("GOAGAIN_ADDR_FD", fmt.Sprint(t.report.w.Fd()))
+}
+
+// An address as a child reported it.
+type reportedAddr struct {
+	network, addr string
+}
+
+func (a reportedAddr) Network() string { return a.network }
+func (a reportedAddr) String() string  { return a.addr }
+
+var (
+	boundMu sync.Mutex
+	bound   net.Addr
+)
+
+// Record the address this child actually bound, for the parent to find in
+// RestartResult.ChildAddr once we're ready.  Only a parent in rebind mode
+// asks, since a passed listener keeps the parent's address, or one with a
+// Config.CompatCheck to probe us at.  Rebind reports its listener itself;
+// call this after binding any other way, for instance on a port the OS
+// assigned or a private admin port.
+func ReportAddr(a net.Addr) {
+	boundMu.Lock()
+	bound = a
+	boundMu.Unlock()
+}
+
+// Write the reported address, if any, to the pipe our parent passed, and
+// close it either way.  Kill calls this as part of confirming we're ready.
+func sendAddrReport() {
+	var fd uintptr
+	if _, err := fmt.Sscan(os.Getenv("GOAGAIN_ADDR_FD"), &fd); nil != err {
+		return
+	}
+	unsetenv("GOAGAIN_ADDR_FD")
+	f := os.NewFile(fd, "goagain-addr")
+	defer f.Close()
+	boundMu.Lock()
+	a := bound
+	boundMu.Unlock()
+	if nil == a {
+		return
+	}
+	if _, err := fmt.Fprintln(f, a.Network(), a.String()); nil != err {
+		logln("Unable to report our address to the parent:", err)
+	}
+}
@@ -0,0 +1,164 @@
+package goagain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// How a restart ended, for deploy tooling to branch on without matching
+// errors itself.
+type Outcome string
+
+const (
+	OutcomeSucceeded          Outcome = "succeeded"            // the child took over
+	OutcomeAborted            Outcome = "aborted"              // the child sent the abort signal
+	OutcomeChildDied          Outcome = "child-died"           // the child exited before it was ready or during standby
+	OutcomeTimedOut           Outcome = "timed-out"            // Config.Timeout or Config.Deadline ran out
+	OutcomeVerifyFailed       Outcome = "verify-failed"        // Config.Verify rejected the child
+	OutcomeIncompatible       Outcome = "incompatible"         // Config.CompatCheck rejected the child
+	OutcomeNotExternallyReady Outcome = "not-externally-ready" // Config.ExternalReady never reported the child ready
+	OutcomeCancelled          Outcome = "cancelled"            // the caller's context was cancelled
+	OutcomeTooDisruptive      Outcome = "too-disruptive"       // the drain force-closed more than Config.MaxForceClose
+	OutcomeFailed             Outcome = "failed"               // anything else, say the fork itself
+)
+
+// Everything known about one restart, gathered for a caller to log or emit as
+// a single event.
+type RestartResult struct {
+
+	// The parent's pid and the last child's, or zero if none was spawned.
+	// With ForkRetries that's the child of the final attempt.
+	OldPid, NewPid int
+
+	// When the fork signal was accepted.
+	Start time.Time
+
+	// The fork signal that triggered the restart.  Nil for a restart
+	// triggered some other way, such as by WatchBinary.
+	Signal os.Signal
+
+	Timing RestartTiming
+
+	// In rebind mode or with Config.CompatCheck, the address the child
+	// reported with Rebind or ReportAddr, which may differ from the
+	// parent's.  Nil otherwise or if the child didn't report one.
+	ChildAddr net.Addr
+
+	// How many connections closed on their own while draining and how many
+	// were still open at the drain timeout and were force-closed.  Only
+	// Group.RunResult and goagainhttp drain, so elsewhere these are zero.
+	Drained, ForceClosed int
+
+	// How each of a Group's servers drained, in the order they were added.
+	Servers []ServerDrain
+
+	Outcome Outcome
+
+	// The error the restart failed with, if it did.
+	Err error
+}
+
+// How one of a Group's servers drained after the handoff.
+type ServerDrain struct {
+	Addr                 net.Addr
+	Drained, ForceClosed int
+	Duration             time.Duration
+
+	// ErrDrainTimeout if connections had to be force-closed, or whatever
+	// closing the listener failed with.
+	Err error
+}
+
+// Wait like Wait and also report the restart's result.
+func (h *Handler) WaitResult(l net.Listener) (RestartResult, error) {
+	err := h.Wait(l)
+	return h.LastResult(), err
+}
+
+// The error a restart ends with when its drain force-closed more
+// connections than Config.MaxForceClose allows.
+var ErrTooDisruptive = errors.New("drain force-closed too many connections")
+
+// Hold r to Config.MaxForceClose once the drain has filled in ForceClosed,
+// marking it too disruptive if it went over.
+func (h *Handler) checkForceClose(r *RestartResult) {
+	if 0 < h.cfg.MaxForceClose && r.ForceClosed > h.cfg.MaxForceClose {
+		r.Outcome = OutcomeTooDisruptive
+		r.Err = fmt.Errorf("%w: %d force-closed, budget %d", ErrTooDisruptive, r.ForceClosed, h.cfg.MaxForceClose)
+	}
+}
+
+// The result of the latest restart this Handler began, filled in as far as
+// it got, or the zero value before the first.
+func (h *Handler) LastResult() RestartResult {
+	h.resultMu.Lock()
+	defer h.resultMu.Unlock()
+	return h.result
+}
+
+// Start the result of a new restart.
+func (h *Handler) beginResult(r RestartResult) {
+	h.resultMu.Lock()
+	defer h.resultMu.Unlock()
+	h.result, h.archived = r, false
+}
+
+// Update the latest restart's result, in the history too once it's there.
+func (h *Handler) recordResult(f func(*RestartResult)) {
+	h.resultMu.Lock()
+	defer h.resultMu.Unlock()
+	f(&h.result)
+	if h.archived {
+		h.history[len(h.history)-1] = h.result
+	}
+}
+
+// How many finished restarts History keeps.
+const historySize = 32
+
+// The results of the restarts this Handler has finished, oldest first, up to
+// the last 32.  A Group's drain is filled in once it's done; goagainhttp's
+// is only in the result ServeHTTPResult returns.
+func (h *Handler) History() []RestartResult {
+	h.resultMu.Lock()
+	defer h.resultMu.Unlock()
+	return append([]RestartResult(nil), h.history...)
+}
+
+// Add the latest restart's result, now final, to the history.
+func (h *Handler) archiveResult() {
+	h.resultMu.Lock()
+	defer h.resultMu.Unlock()
+	if len(h.history) == historySize {
+		h.history = append(h.history[:0], h.history[1:]...)
+	}
+	h.history = append(h.history, h.result)
+	h.archived = true
+}
+
+// Classify the error a restart ended with.
+func outcomeOf(err error) Outcome {
+	switch {
+	case nil == err:
+		return OutcomeSucceeded
+	case errors.Is(err, ErrRestartAborted):
+		return OutcomeAborted
+	case errors.Is(err, ErrChildDied), errors.Is(err, ErrChildExited):
+		return OutcomeChildDied
+	case errors.Is(err, ErrReadyTimeout), errors.Is(err, context.DeadlineExceeded):
+		return OutcomeTimedOut
+	case errors.Is(err, ErrVerifyFailed):
+		return OutcomeVerifyFailed
+	case errors.Is(err, ErrIncompatible):
+		return OutcomeIncompatible
+	case errors.Is(err, ErrNotExternallyReady):
+		return OutcomeNotExternallyReady
+	case errors.Is(err, context.Canceled):
+		return OutcomeCancelled
+	}
+	return OutcomeFailed
+}
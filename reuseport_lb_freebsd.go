@@ -0,0 +1,4 @@
+package goagain
+
+// SO_REUSEPORT_LB, which package syscall doesn't define on FreeBSD.
+const soReusePortLB = 0x10000
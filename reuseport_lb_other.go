@@ -0,0 +1,6 @@
+//go:build !freebsd
+
+package goagain
+
+// Only FreeBSD has SO_REUSEPORT_LB; Linux's SO_REUSEPORT already balances.
+const soReusePortLB = soReusePort
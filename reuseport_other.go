@@ -0,0 +1,7 @@
+//go:build !linux
+
+package goagain
+
+import "syscall"
+
+const soReusePort = syscall.SO_REUSEPORT
@@ -0,0 +1,42 @@
+package goagain
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The binary we're running, for when os.Args[0] doesn't lead to it.  That's
+// the path /proc/self/exe links to if it's still there, else /proc/self/exe
+// itself: exec'ing that from the forked child runs the very same image, as
+// fexecve would, even when it was launched from a memfd or has since been
+// deleted.  Either way this is the current binary, not whatever has since
+// been deployed under its name.
+func selfExe() (string, error) {
+	target, err := os.Readlink("/proc/self/exe")
+	if nil != err {
+		return "", err
+	}
+	if !strings.HasSuffix(target, " (deleted)") && nil == checkExecutable(target) {
+		return target, nil
+	}
+	return "/proc/self/exe", nil
+}
+
+// Whether we were exec'd from a memfd, typically a sealed one holding a
+// verified binary.  Its path is only a label, so os.Args[0] can only lead to
+// a different file.
+func memfdLaunched() bool {
+	target, err := os.Readlink("/proc/self/exe")
+	return nil == err && strings.HasPrefix(target, "/memfd:")
+}
+
+// A path that execs the very image we're running.  From the forked child
+// /proc/self/exe still refers to it, so this is as good as an execveat(2)
+// of a memfd, without needing the fd kept open.
+func runningImage() (string, error) {
+	if _, err := os.Stat("/proc/self/exe"); nil != err {
+		return "", fmt.Errorf("re-exec'ing the running image needs /proc: %w", err)
+	}
+	return "/proc/self/exe", nil
+}
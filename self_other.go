@@ -0,0 +1,19 @@
+//go:build !linux
+
+package goagain
+
+import "errors"
+
+// Without /proc there's no way back to a binary os.Args[0] doesn't name.
+func selfExe() (string, error) {
+	return "", errors.New("finding the running binary without os.Args[0] is only supported on Linux")
+}
+
+// Only Linux launches binaries from memfds.
+func memfdLaunched() bool {
+	return false
+}
+
+func runningImage() (string, error) {
+	return "", errors.New("re-exec'ing the running image is only supported on Linux")
+}
@@ -0,0 +1,143 @@
+package goagain
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// The states a child reports through Config.SharedMemory.
+const (
+	shmWaiting uint32 = iota
+	shmReady
+	shmAbort
+)
+
+// How often the parent polls the shared region.  A millisecond is far below
+// anything a handoff notices yet costs next to nothing in wakeups.
+const shmPollInterval = time.Millisecond
+
+// A page of memory shared between parent and child, backed by an unlinked
+// temporary file whose fd the child inherits.  Only its first word is used.
+type sharedState struct {
+	f   *os.File
+	mem []byte
+}
+
+// Make a fresh region for a child to report into.
+func newSharedState() (*sharedState, error) {
+	f, err := os.CreateTemp("", "goagain-shm-")
+	if nil != err {
+		return nil, err
+	}
+	os.Remove(f.Name())
+	if err := f.Truncate(int64(os.Getpagesize())); nil != err {
+		f.Close()
+		return nil, err
+	}
+	return mapSharedState(f)
+}
+
+// Map the region in f.
+func mapSharedState(f *os.File) (*sharedState, error) {
+	mem, err := syscall.Mmap(
+		int(f.Fd()),
+		0,
+		os.Getpagesize(),
+		syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_SHARED,
+	)
+	if nil != err {
+		f.Close()
+		return nil, err
+	}
+	return &sharedState{f: f, mem: mem}, nil
+}
+
+func (s *sharedState) word() *uint32 {
+	return (*uint32)(unsafe.Pointer(&s.mem[0]))
+}
+
+func (s *sharedState) close() {
+	syscall.Munmap(s.mem)
+	s.f.Close()
+}
+
+// Poll the region until the child reports, delivering sig on quitCh when
+// it's ready or on abortCh when it aborts, the way the signals themselves
+// would arrive.  Polling stops with ctx.
+func (s *sharedState) watch(ctx context.Context, sig os.Signal) (quitCh, abortCh <-chan os.Signal) {
+	quit := make(chan os.Signal, 1)
+	abort := make(chan os.Signal, 1)
+	go func() {
+		tick := time.NewTicker(shmPollInterval)
+		defer tick.Stop()
+		for {
+			switch atomic.LoadUint32(s.word()) {
+			case shmReady:
+				quit <- sig
+				return
+			case shmAbort:
+				abort <- sig
+				return
+			}
+			select {
+			case <-tick.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return quit, abort
+}
+
+var (
+	inheritedStateOnce sync.Once
+	inheritedState     *sharedState
+)
+
+// The region our parent passed in GOAGAIN_SHM_FD, or nil if it's using
+// signals.  Once we've spawned a child of our own, Kill is aimed at it
+// rather than our parent, so the region no longer applies.
+func parentSharedState() *sharedState {
+	if "" != os.Getenv("GOAGAIN_PID") {
+		return nil
+	}
+	inheritedStateOnce.Do(func() {
+		var fd uintptr
+		if _, err := fmt.Sscan(os.Getenv("GOAGAIN_SHM_FD"), &fd); nil != err {
+			return
+		}
+		s, err := mapSharedState(os.NewFile(fd, "goagain-shm"))
+		if nil != err {
+			logln("Unable to map GOAGAIN_SHM_FD, falling back to signals:", err)
+			return
+		}
+		inheritedState = s
+	})
+	return inheritedState
+}
+
+// Record the shared region's fd for the child, or clear one we inherited.
+func (t handoff) setSharedStateEnv() error {
+	if nil == t.shm {
+		return unsetenv("GOAGAIN_SHM_FD")
+	}
+	return setenv("GOAGAIN_SHM_FD", fmt.Sprint(t.shm.f.Fd()))
+}
+
+// Report state to our parent through the shared region, if it gave us one.
+func reportSharedState(state uint32) bool {
+	s := parentSharedState()
+	if nil == s {
+		return false
+	}
+	logln("reporting state", state, "to parent through shared memory")
+	atomic.StoreUint32(s.word(), state)
+	return true
+}
@@ -0,0 +1,56 @@
+package goagain
+
+import (
+	"syscall"
+)
+
+// The signals one restart runs with, fixed when it begins.
+type signalSet struct {
+	fork, quit, ready, abort syscall.Signal
+}
+
+// The signal a child confirms with: ready if set, else quit.
+func (s signalSet) confirm() syscall.Signal {
+	if 0 != s.ready {
+		return s.ready
+	}
+	return s.quit
+}
+
+// Change the signals that trigger, confirm and abort a restart, say to suit
+// an orchestrator's conventions read from config after startup.  Zero fork
+// or quit means the default, as in Config; zero ready or abort means none.
+//
+// A restart already under way finishes with the signals it started with.  A
+// Wait blocked on the fork signal switches to the new one straight away,
+// stopping its handler for the old, and everything else applies from the
+// next fork signal.  Channels the caller passed to WaitWithChannel or a fork
+// signal caught by Init are the caller's and aren't re-registered.
+func (h *Handler) SetSignals(fork, quit, ready, abort syscall.Signal) {
+	if 0 == fork {
+		fork = syscall.SIGHUP
+	}
+	if 0 == quit {
+		quit = syscall.SIGQUIT
+	}
+	h.sigMu.Lock()
+	h.sigs = signalSet{fork, quit, ready, abort}
+	close(h.sigsChanged)
+	h.sigsChanged = make(chan struct{})
+	h.sigMu.Unlock()
+	h.holdSignals()
+}
+
+// The signals currently in force, as SetSignals last set them or Config had
+// them, with the defaults filled in.
+func (h *Handler) Signals() (fork, quit, ready, abort syscall.Signal) {
+	sigs, _ := h.signals()
+	return sigs.fork, sigs.quit, sigs.ready, sigs.abort
+}
+
+// The current signals and a channel closed when SetSignals next changes them.
+func (h *Handler) signals() (signalSet, <-chan struct{}) {
+	h.sigMu.Lock()
+	defer h.sigMu.Unlock()
+	return h.sigs, h.sigsChanged
+}
@@ -0,0 +1,120 @@
+package goagain
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"syscall"
+)
+
+// Returned when an inherited fd isn't the very socket the parent passed, as
+// recorded in GOAGAIN_INODE, but some other socket that happened to be
+// there.  Serving on it would drop the connections meant for the real one.
+var ErrSocketMismatch = errors.New("inherited fd is not the socket the parent passed")
+
+// The socket type each network's sockets have.
+var networkSocketTypes = map[string]int{
+	"tcp":        syscall.SOCK_STREAM,
+	"tcp4":       syscall.SOCK_STREAM,
+	"tcp6":       syscall.SOCK_STREAM,
+	"unix":       syscall.SOCK_STREAM,
+	"unixpacket": syscall.SOCK_SEQPACKET,
+	"udp":        syscall.SOCK_DGRAM,
+	"udp4":       syscall.SOCK_DGRAM,
+	"udp6":       syscall.SOCK_DGRAM,
+	"unixgram":   syscall.SOCK_DGRAM,
+}
+
+// The getsockopt the socket checks use, a seam so a platform lacking an
+// option can be simulated.
+var getsockoptInt = syscall.GetsockoptInt
+
+// Check an inherited fd against the network its parent recorded for it in
+// GOAGAIN_NET.  A mismatch means the environment is corrupt or the fd isn't
+// the one the parent meant, and reconstructing it would fail confusingly or,
+// worse, serve the wrong socket.  Only stream sockets can be listeners; any
+// other type is refused.  An empty network, as from a parent that predates
+// GOAGAIN_NET or from systemd, is only held to being a stream socket.
+func checkSocketType(fd uintptr, network string) error {
+	var typ int
+	err := retryEINTR(func() (err error) {
+		typ, err = getsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_TYPE)
+		return
+	})
+	if nil != err {
+		return fmt.Errorf("fd %d: SO_TYPE: %w", fd, err)
+	}
+	if "" != network {
+		want, ok := networkSocketTypes[network]
+		if !ok {
+			return fmt.Errorf("fd %d: unknown network %q in GOAGAIN_NET", fd, network)
+		}
+		if typ != want {
+			return fmt.Errorf(
+				"fd %d: GOAGAIN_NET is %s but the socket's SO_TYPE is %d not %d",
+				fd,
+				network,
+				typ,
+				want,
+			)
+		}
+	}
+	if syscall.SOCK_STREAM != typ && syscall.SOCK_SEQPACKET != typ {
+		return fmt.Errorf("fd %d: socket type %d can't be a listener", fd, typ)
+	}
+	return checkListening(fd)
+}
+
+// Check that fd is a listening socket rather than, say, a connection that
+// landed on the fd number, which FileListener would accept and Accept would
+// then fail on.  This is best-effort: where SO_ACCEPTCONN isn't supported,
+// as on older macOS, the check is skipped rather than failing the restart.
+func checkListening(fd uintptr) error {
+	var on int
+	err := retryEINTR(func() (err error) {
+		on, err = getsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_ACCEPTCONN)
+		return
+	})
+	if errors.Is(err, syscall.ENOPROTOOPT) {
+		logln("SO_ACCEPTCONN unsupported, not checking that fd", fd, "is listening")
+		return nil
+	}
+	if nil != err {
+		return fmt.Errorf("fd %d: SO_ACCEPTCONN: %w", fd, err)
+	}
+	if 0 == on {
+		return fmt.Errorf("fd %d: socket isn't listening", fd)
+	}
+	return nil
+}
+
+// Check an inherited fd against the socket inode its parent recorded.  An
+// empty inode, from a parent that predates GOAGAIN_INODE, from systemd or on
+// a platform that doesn't check, passes.
+func checkSocketInode(fd uintptr, inode string) error {
+	if "" == inode {
+		return nil
+	}
+	want, err := strconv.ParseUint(inode, 10, 64)
+	if nil != err {
+		return fmt.Errorf("%w: GOAGAIN_INODE %q", ErrSocketMismatch, inode)
+	}
+	got, ok, err := socketInode(fd)
+	if nil != err {
+		return fmt.Errorf("fd %d: fstat: %w", fd, err)
+	}
+	if ok && got != want {
+		return fmt.Errorf("%w: fd %d is inode %d not %d", ErrSocketMismatch, fd, got, want)
+	}
+	return nil
+}
+
+// The inode to record for the socket open on fd, or "" where that isn't
+// checked.
+func recordedInode(fd uintptr) string {
+	ino, ok, err := socketInode(fd)
+	if nil != err || !ok {
+		return ""
+	}
+	return fmt.Sprint(ino)
+}
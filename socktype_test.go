@@ -0,0 +1,138 @@
+package goagain
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// Stand in for getsockopt, failing with EINTR the first time for each
+// option before answering with the stream type and a listening socket.
+func interruptedGetsockopt(t *testing.T) {
+	get := getsockoptInt
+	t.Cleanup(func() { getsockoptInt = get })
+	interrupted := make(map[int]bool)
+	getsockoptInt = func(fd, level, opt int) (int, error) {
+		if !interrupted[opt] {
+			interrupted[opt] = true
+			return 0, syscall.EINTR
+		}
+		if syscall.SO_TYPE == opt {
+			return syscall.SOCK_STREAM, nil
+		}
+		return 1, nil
+	}
+}
+
+// An interrupted getsockopt is retried rather than failing the check.
+func TestSocketChecksRetryEINTR(t *testing.T) {
+	interruptedGetsockopt(t)
+	if err := checkSocketType(3, "tcp"); nil != err {
+		t.Errorf("checkSocketType: %v", err)
+	}
+	if err := checkListening(3); nil != err {
+		t.Errorf("checkListening: %v", err)
+	}
+}
+
+// An fd of a real socket, closed once t is done.
+func socketFd(t *testing.T, f *os.File, err error) uintptr {
+	if nil != err {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f.Fd()
+}
+
+func TestCheckSocketType(t *testing.T) {
+	tcp, err := listenerFile(listenTCP(t))
+	tcpFd := socketFd(t, tcp, err)
+	packet, err := net.Listen("unixpacket", filepath.Join(t.TempDir(), "sock"))
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer packet.Close()
+	pkt, err := listenerFile(packet)
+	packetFd := socketFd(t, pkt, err)
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	uf, err := udp.(*net.UDPConn).File()
+	udpFd := socketFd(t, uf, err)
+
+	for _, tt := range []struct {
+		name    string
+		fd      uintptr
+		network string
+		ok      bool
+	}{
+		{"tcp", tcpFd, "tcp", true},
+		{"tcp6 recorded", tcpFd, "tcp6", true},
+		{"nothing recorded", tcpFd, "", true},
+		{"unixpacket", packetFd, "unixpacket", true},
+		{"recorded as udp", tcpFd, "udp", false},
+		{"recorded as unixpacket", tcpFd, "unixpacket", false},
+		{"unknown network", tcpFd, "carrier-pigeon", false},
+		{"udp", udpFd, "udp", false},
+		{"udp unrecorded", udpFd, "", false},
+	} {
+		if err := checkSocketType(tt.fd, tt.network); tt.ok != (nil == err) {
+			t.Errorf("%s: checkSocketType = %v", tt.name, err)
+		}
+	}
+}
+
+// Stand in for getsockopt, answering SO_ACCEPTCONN with on and err.
+func acceptConn(t *testing.T, on int, err error) {
+	get := getsockoptInt
+	t.Cleanup(func() { getsockoptInt = get })
+	getsockoptInt = func(fd, level, opt int) (int, error) {
+		if syscall.SO_ACCEPTCONN != opt {
+			return get(fd, level, opt)
+		}
+		return on, err
+	}
+}
+
+func TestCheckListening(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		on   int
+		err  error
+		ok   bool
+	}{
+		{"listening", 1, nil, true},
+		{"unsupported", 0, syscall.ENOPROTOOPT, true},
+		{"not listening", 0, nil, false},
+		{"bad fd", 0, syscall.EBADF, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			acceptConn(t, tt.on, tt.err)
+			if err := checkListening(3); tt.ok != (nil == err) {
+				t.Errorf("checkListening = %v", err)
+			}
+		})
+	}
+}
+
+// A real socket that's bound but not listening is refused.
+func TestCheckListeningUnlistened(t *testing.T) {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	f, err := udp.(*net.UDPConn).File()
+	fd := socketFd(t, f, err)
+	if err := checkListening(fd); nil == err {
+		t.Error("checkListening passed a socket that isn't listening")
+	}
+	l, err := listenerFile(listenTCP(t))
+	if err := checkListening(socketFd(t, l, err)); nil != err {
+		t.Errorf("checkListening of a listener: %v", err)
+	}
+}
@@ -0,0 +1,248 @@
+package goagain
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// Called with each child goagain reaps once it's gone, its fds released and
+// its exit status collected, say for a supervisor to deregister a worker at
+// exactly that moment.  That covers children forked by a restart that are
+// reaped while we're still running, such as one killed after failing, and,
+// while this is set, workers started by SpawnWith.  Unlike
+// Config.OnParentExit, this runs in the process that outlives the one gone.
+var OnChildExit func(pid int, state *os.ProcessState)
+
+func childExited(pid int, state *os.ProcessState) {
+	logln("child", pid, "exited:", state)
+	if nil != OnChildExit {
+		OnChildExit(pid, state)
+	}
+}
+
+// Start cmd, which needn't be a copy of this program, passing it listeners so
+// it can pick them up with Listener or Listeners.  This is for a supervisor
+// that holds the sockets and hands them to workers it spawns.  The listener
+// files are appended to cmd.ExtraFiles and the GOAGAIN_* variables to
+// cmd.Env, or to os.Environ() if that's nil, in place of any already there.
+// With OnChildExit set, goagain reaps the worker itself, so the caller
+// mustn't Wait for it.
+func SpawnWith(cmd *exec.Cmd, listeners ...net.Listener) (*os.Process, error) {
+	files, err := injectListeners(cmd, listeners)
+	defer closeFiles(files)
+	if nil != err {
+		return nil, err
+	}
+	// Start calls Fd on each ExtraFiles entry, putting the listeners'
+	// sockets in blocking mode; see forkExec.
+	nb := nonblockingFds(files)
+	err = cmd.Start()
+	nb.restore()
+	if nil != err {
+		return nil, err
+	}
+	logln("spawned", cmd.Path, cmd.Process.Pid)
+	if nil != OnChildExit {
+		go func() {
+			cmd.Wait()
+			if nil != cmd.ProcessState {
+				childExited(cmd.Process.Pid, cmd.ProcessState)
+			}
+		}()
+	}
+	return cmd.Process, nil
+}
+
+// Set cmd up to inherit l, for a caller that manages its own exec.Cmd and
+// starts it itself: a dup of l's fd is appended to cmd.ExtraFiles and the
+// GOAGAIN_* variables naming it, numbered to suit whatever ExtraFiles
+// already holds, to cmd.Env, or to os.Environ() if that's nil, in place of
+// any GOAGAIN_* variables already there.  The child picks l up with
+// Listener.  The returned dup is the caller's to close once cmd has
+// started.  Call it once per cmd; SpawnWith passes several listeners.
+//
+// cmd.Start calls Fd on the dup, which puts l itself in blocking mode, so
+// its deadlines stop working and a blocked Accept holds up Close.  A caller
+// that goes on accepting on l should call syscall.SetNonblock(int(f.Fd()),
+// true) on the dup after Start and before closing it, as SpawnWith does.
+func InjectListener(cmd *exec.Cmd, l net.Listener) (*os.File, error) {
+	files, err := injectListeners(cmd, []net.Listener{l})
+	if nil != err {
+		closeFiles(files)
+		return nil, err
+	}
+	return files[0], nil
+}
+
+// Add listeners to cmd as numbered GOAGAIN_FD_<i>, GOAGAIN_NAME_<i> and
+// GOAGAIN_NET_<i> slots with GOAGAIN_FD_COUNT, the first also as plain
+// GOAGAIN_FD, GOAGAIN_NAME and GOAGAIN_NET for Listener.  Whatever GOAGAIN_
+// variables cmd would otherwise inherit, such as the slots our own parent
+// passed us, are dropped.  The returned files are ours to close once cmd
+// has started.
+func injectListeners(cmd *exec.Cmd, listeners []net.Listener) ([]*os.File, error) {
+	if err := checkNames(listeners); nil != err {
+		return nil, err
+	}
+	base := cmd.Env
+	if nil == base {
+		base = os.Environ()
+	}
+	var env []string
+	for _, kv := range base {
+		if !strings.HasPrefix(kv, "GOAGAIN_") {
+			env = append(env, kv)
+		}
+	}
+	env = append(
+		env,
+		fmt.Sprintf("GOAGAIN_PROTO_VERSION=%d", protocolVersion),
+		"GOAGAIN_PID=",
+		fmt.Sprintf("GOAGAIN_PPID=%d", syscall.Getpid()),
+		fmt.Sprintf("GOAGAIN_FD_COUNT=%d", len(listeners)),
+	)
+	files := make([]*os.File, 0, len(listeners))
+	for i, l := range listeners {
+		f, err := listenerFile(l)
+		if nil != err {
+			return files, err
+		}
+		files = append(files, f)
+
+		// ExtraFiles[j] becomes fd 3+j in the child.
+		fd := 3 + len(cmd.ExtraFiles) + i
+		name := listenerName(l)
+		env = append(
+			env,
+			fmt.Sprintf("GOAGAIN_FD_%d=%d", i, fd),
+			fmt.Sprintf("GOAGAIN_NAME_%d=%s", i, name),
+			fmt.Sprintf("GOAGAIN_NET_%d=%s", i, l.Addr().Network()),
+			fmt.Sprintf("GOAGAIN_FDNAME_%d=%s", i, ListenerName(l)),
+			fmt.Sprintf("GOAGAIN_INODE_%d=%s", i, recordedInode(sysfd(f))),
+		)
+		if 0 == i {
+			env = append(
+				env,
+				fmt.Sprintf("GOAGAIN_FD=%d", fd),
+				fmt.Sprintf("GOAGAIN_NAME=%s", name),
+				fmt.Sprintf("GOAGAIN_NET=%s", l.Addr().Network()),
+				fmt.Sprintf("GOAGAIN_FDNAME=%s", ListenerName(l)),
+				fmt.Sprintf("GOAGAIN_INODE=%s", recordedInode(sysfd(f))),
+			)
+		}
+	}
+	cmd.ExtraFiles = append(cmd.ExtraFiles, files...)
+	cmd.Env = env
+	return files, nil
+}
+
+// Reconstruct every listener passed by SpawnWith, in order.  A single
+// listener passed by Wait is returned alone.
+func Listeners() ([]net.Listener, error) {
+	var n int
+	if _, err := fmt.Sscan(os.Getenv("GOAGAIN_FD_COUNT"), &n); nil != err {
+		l, err := Listener()
+		if nil != err {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+	if err := checkProtocolVersion(); nil != err {
+		return nil, err
+	}
+	if err := checkSlots(n); nil != err {
+		return nil, err
+	}
+	inheritGOMAXPROCS()
+	ls := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		l, err := listenerSlot(i)
+		if nil != err {
+			closeListeners(ls)
+			return nil, err
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+// Returned by Listeners when GOAGAIN_FD_COUNT promises slots the
+// environment or the fd table doesn't back up, say after a deploy script
+// rewrote the environment by hand.
+var ErrBadSlot = errors.New("inconsistent listener slots")
+
+// Check every one of the n numbered slots before reconstructing any, so a
+// missing or stale one is reported by number rather than as a failure partway
+// through.
+func checkSlots(n int) error {
+	seen := make(map[uintptr]int, n)
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("GOAGAIN_FD_%d", i)
+		s, ok := os.LookupEnv(key)
+		if !ok {
+			return fmt.Errorf("%w: GOAGAIN_FD_COUNT is %d but %s is missing", ErrBadSlot, n, key)
+		}
+		var fd uintptr
+		if _, err := fmt.Sscan(s, &fd); nil != err {
+			return fmt.Errorf("%w: %s is %q: %v", ErrBadSlot, key, s, err)
+		}
+		if _, ok := os.LookupEnv(fmt.Sprintf("GOAGAIN_NAME_%d", i)); !ok {
+			return fmt.Errorf("%w: %s is set but GOAGAIN_NAME_%d is missing", ErrBadSlot, key, i)
+		}
+		if j, ok := seen[fd]; ok {
+			return fmt.Errorf("%w: slots %d and %d both name fd %d", ErrBadSlot, j, i, fd)
+		}
+		seen[fd] = i
+		if err := fdOpen(fd); nil != err {
+			return fmt.Errorf("%w: slot %d names fd %d: %w", ErrBadSlot, i, fd, err)
+		}
+	}
+	return nil
+}
+
+// Check that fd is open in this process.
+func fdOpen(fd uintptr) error {
+	return retryEINTR(func() error {
+		if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_GETFD, 0); 0 != errno {
+			return errno
+		}
+		return nil
+	})
+}
+
+// Reconstruct the listener in the numbered slot i.
+func listenerSlot(i int) (net.Listener, error) {
+	var fd uintptr
+	key := fmt.Sprintf("GOAGAIN_FD_%d", i)
+	if _, err := fmt.Sscan(os.Getenv(key), &fd); nil != err {
+		return nil, fmt.Errorf("%s: %v", key, err)
+	}
+	l, err := fileListener(
+		fd,
+		os.Getenv(fmt.Sprintf("GOAGAIN_NAME_%d", i)),
+		os.Getenv(fmt.Sprintf("GOAGAIN_NET_%d", i)),
+		os.Getenv(fmt.Sprintf("GOAGAIN_INODE_%d", i)),
+	)
+	if nil != err {
+		return nil, err
+	}
+	l = inheritKeepAlive(l)
+	return inheritName(l, os.Getenv(fmt.Sprintf("GOAGAIN_FDNAME_%d", i))), nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+func closeListeners(ls []net.Listener) {
+	for _, l := range ls {
+		l.Close()
+	}
+}
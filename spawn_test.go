@@ -0,0 +1,135 @@
+package goagain
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+// The number of fds open in this process.
+func openFds(t *testing.T) int {
+	fds, err := os.ReadDir("/dev/fd")
+	if nil != err {
+		t.Skip("can't list open fds:", err)
+	}
+	return len(fds)
+}
+
+// The injected variables replace any GOAGAIN_ ones cmd would have started
+// with, and the dup returned is the one cmd passes.
+func TestInjectListenerEnv(t *testing.T) {
+	cmd := exec.Command("true")
+	cmd.Env = []string{"PATH=/bin", "GOAGAIN_FD=9", "GOAGAIN_FD_3=12"}
+	f, err := InjectListener(cmd, listenTCP(t))
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if 1 != len(cmd.ExtraFiles) || f != cmd.ExtraFiles[0] {
+		t.Errorf("ExtraFiles %v, want just %v", cmd.ExtraFiles, f)
+	}
+	env := make(map[string]int)
+	for _, kv := range cmd.Env {
+		env[kv]++
+	}
+	for _, kv := range []string{"PATH=/bin", "GOAGAIN_FD=3", "GOAGAIN_FD_0=3", "GOAGAIN_FD_COUNT=1"} {
+		if 1 != env[kv] {
+			t.Errorf("%s appears %d times", kv, env[kv])
+		}
+	}
+	for _, kv := range []string{"GOAGAIN_FD=9", "GOAGAIN_FD_3=12"} {
+		if 0 != env[kv] {
+			t.Errorf("stale %s kept", kv)
+		}
+	}
+}
+
+// A child started with files in ExtraFiles already finds the injected
+// listener at the fd its variables name, after those files.
+func TestInjectListenerChild(t *testing.T) {
+	l := listenTCP(t)
+	devNull, err := os.Open(os.DevNull)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "STANDIN_CHILD=accept")
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{devNull, devNull}
+	f, err := InjectListener(cmd, l)
+	if nil != err {
+		t.Fatal(err)
+	}
+	err = cmd.Start()
+	f.Close()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if got := childSays(t, "tcp", l.Addr().String()); "ok" != got {
+		t.Errorf("child sent %q, want ok", got)
+	}
+	if err := cmd.Wait(); nil != err {
+		t.Errorf("child: %v", err)
+	}
+}
+
+// Spawning worker after worker with the same listeners leaves no dups behind
+// in the supervisor.
+func TestSpawnWithKeepsFdsStable(t *testing.T) {
+	ls := []net.Listener{listenTCP(t), listenUnix(t)}
+	spawn := func() {
+		cmd := exec.Command(os.Args[0])
+		cmd.Env = append(os.Environ(), "STANDIN_CHILD=exit")
+		if _, err := SpawnWith(cmd, ls...); nil != err {
+			t.Fatal(err)
+		}
+		cmd.Wait()
+	}
+	spawn()
+	before := openFds(t)
+	for i := 0; i < 20; i++ {
+		spawn()
+	}
+	if after := openFds(t); before != after {
+		t.Errorf("%d fds open after 20 spawns, %d before", after, before)
+	}
+}
+
+// Every slot is checked before any is reconstructed, and the first
+// inconsistent one is reported as ErrBadSlot.
+func TestListenersChecksSlots(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		spoil func()
+	}{
+		{"consistent", func() {}},
+		{"count too high", func() { os.Setenv("GOAGAIN_FD_COUNT", "3") }},
+		{"fd not a number", func() { os.Setenv("GOAGAIN_FD_1", "three") }},
+		{"name missing", func() { os.Unsetenv("GOAGAIN_NAME_1") }},
+		{"fd repeated", func() { os.Setenv("GOAGAIN_FD_1", os.Getenv("GOAGAIN_FD_0")) }},
+		{"fd closed", func() { os.Setenv("GOAGAIN_FD_1", "1000") }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			passToSelf(t, listenTCP(t), listenTCP(t))
+			tt.spoil()
+			before := openFds(t)
+			ls, err := Listeners()
+			closeListeners(ls)
+			if "consistent" == tt.name {
+				if nil != err || 2 != len(ls) {
+					t.Fatalf("Listeners = %d listeners, %v", len(ls), err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrBadSlot) {
+				t.Fatalf("Listeners: %v, want %v", err, ErrBadSlot)
+			}
+			if after := openFds(t); before != after {
+				t.Errorf("%d fds open after the refusal, %d before", after, before)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package goagain
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// The first file descriptor systemd passes a socket-activated service.
+const listenFdsStart = 3
+
+// Reconstruct the listener a goagain parent passed under name, given with
+// Named, or else the socket-activated listener systemd named name, as set
+// with FileDescriptorName= in the .socket unit and passed in LISTEN_FDNAMES.
+func ListenerByName(name string) (net.Listener, error) {
+	if l, ok, err := nativeListenerByName(name); ok {
+		return l, err
+	}
+	fds, err := systemdFdNames()
+	if nil != err {
+		return nil, err
+	}
+	fd, ok := fds[name]
+	if !ok {
+		return nil, fmt.Errorf("no socket named %q in LISTEN_FDNAMES", name)
+	}
+	return fileListener(fd, name, "", "")
+}
+
+// Map each name in LISTEN_FDNAMES to its file descriptor, checking that the
+// fds were meant for this process.
+func systemdFdNames() (map[string]uintptr, error) {
+	var pid, n int
+	if _, err := fmt.Sscan(os.Getenv("LISTEN_PID"), &pid); nil != err {
+		return nil, fmt.Errorf("LISTEN_PID: %v", err)
+	}
+	if pid != syscall.Getpid() {
+		return nil, fmt.Errorf(
+			"LISTEN_PID is %d not this process %d",
+			pid,
+			syscall.Getpid(),
+		)
+	}
+	if _, err := fmt.Sscan(os.Getenv("LISTEN_FDS"), &n); nil != err {
+		return nil, fmt.Errorf("LISTEN_FDS: %v", err)
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	if len(names) != n {
+		return nil, fmt.Errorf(
+			"LISTEN_FDNAMES has %d names for %d LISTEN_FDS",
+			len(names),
+			n,
+		)
+	}
+	fds := make(map[string]uintptr, n)
+	for i, name := range names {
+		if _, ok := fds[name]; !ok {
+			fds[name] = uintptr(listenFdsStart + i)
+		}
+	}
+	return fds, nil
+}
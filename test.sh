@@ -11,29 +11,42 @@ findproc() {
     set -x
 }
 
+# Send a signal to the running generation and check the round trip: after
+# the fork signal the child must have sent the quit signal back and the
+# parent exited, leaving exactly one, new, process.  A connection made
+# during the overlap must be served by one generation or the other.
+handoff() {
+    local before after
+    before="$(pgrep -x "single")"
+    pkill "-$1" -x "single"
+    sleep 0.5
+    [ "$(nc "127.0.0.1" "48879")" = "Hello, world!" ]
+    sleep 2.5
+    after="$(pgrep -x "single")"
+    [ "$(echo "$after" | wc -l)" = "1" ]
+    [ "$after" != "$before" ]
+}
+
 pushd "example/single"
 go build
 ./single &
 
 sleep 2
 
-pgrep -f "./single"
+pgrep -x "single"
 
-for _ in _ _
+for sig in "HUP" "HUP" "HUP"
 do
-    sleep 1
-    pkill -HUP -f "./single"
-    sleep 2
-    pgrep -f "./single"
+    handoff "$sig"
 done
 
 [ "$(nc "127.0.0.1" "48879")" = "Hello, world!" ]
 
-pkill -TERM -f "./single"
+pkill -TERM -x "single"
 
 sleep 2
 
-pgrep -f "./single"
+! pgrep -x "single"
 
 
 popd
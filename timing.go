@@ -0,0 +1,49 @@
+package goagain
+
+import (
+	"net"
+	"time"
+)
+
+// How long the most recent restart spent at each stage, for tracking
+// handoff SLOs.  Unlike OnPhase this is a summary read after the fact.
+type RestartTiming struct {
+
+	// From the start of Wait until the fork signal was acted on, including
+	// any time CanRestart deferred it.  Mostly a measure of how long the
+	// process served between restarts.
+	WaitForSignal time.Duration
+
+	// From starting to spawn the child until its quit signal arrived.  This
+	// is the figure to alert on when restarts get slow.
+	ForkToReady time.Duration
+
+	// From the quit signal until Wait returned: Verify, the cutover and any
+	// standby.
+	Handoff time.Duration
+
+	// How long the old generation took to drain its connections.  Only a
+	// Group drains on its own; callers draining a GracefulListener should
+	// time Drain themselves.
+	Drain time.Duration
+}
+
+// Wait like Wait and also report how long the restart took.  The timing is
+// filled in as far as the restart got, even when it failed.
+func (h *Handler) WaitTimed(l net.Listener) (RestartTiming, error) {
+	err := h.Wait(l)
+	return h.LastTiming(), err
+}
+
+// The timing of the latest restart this Handler began, or the zero value
+// before the first.
+func (h *Handler) LastTiming() RestartTiming {
+	return h.LastResult().Timing
+}
+
+// Update the latest restart's timing.
+func (h *Handler) recordTiming(f func(*RestartTiming)) {
+	h.recordResult(func(r *RestartResult) {
+		f(&r.Timing)
+	})
+}
@@ -0,0 +1,137 @@
+// Restart a TLS server with minimal glue: the listening socket is passed as
+// for any goagain server, and the non-secret parts of its tls.Config travel
+// with it so the child serves with an equivalent config.
+//
+// What's passed, as Settings: the minimum and maximum versions, cipher
+// suites, curve preferences, ALPN protocols, the client auth policy and
+// whether session tickets are disabled.  None of that is secret, so it goes
+// in the environment.
+//
+// What the child reloads itself, as it would on first boot: certificates and
+// private keys, GetCertificate and the other callbacks, and the ClientCAs
+// and RootCAs pools.  Session ticket keys aren't passed either; tlskeys
+// carries those, through a pipe rather than the environment.
+//
+// One TLS config is passed per process.
+package tlshandoff
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/blamarvt/goagain"
+)
+
+// The variable the settings are passed in.
+const settingsEnv = "GOAGAIN_TLS_SETTINGS"
+
+// The non-secret parts of a tls.Config.
+type Settings struct {
+	MinVersion             uint16             `json:",omitempty"`
+	MaxVersion             uint16             `json:",omitempty"`
+	CipherSuites           []uint16           `json:",omitempty"`
+	CurvePreferences       []tls.CurveID      `json:",omitempty"`
+	NextProtos             []string           `json:",omitempty"`
+	ClientAuth             tls.ClientAuthType `json:",omitempty"`
+	SessionTicketsDisabled bool               `json:",omitempty"`
+}
+
+// Take the Settings of cfg.
+func SettingsOf(cfg *tls.Config) Settings {
+	return Settings{
+		MinVersion:             cfg.MinVersion,
+		MaxVersion:             cfg.MaxVersion,
+		CipherSuites:           cfg.CipherSuites,
+		CurvePreferences:       cfg.CurvePreferences,
+		NextProtos:             cfg.NextProtos,
+		ClientAuth:             cfg.ClientAuth,
+		SessionTicketsDisabled: cfg.SessionTicketsDisabled,
+	}
+}
+
+// Fill in whichever of s's fields cfg leaves unset, so settings the child
+// configures itself, say a raised MinVersion in the new build, win over the
+// parent's.
+func (s Settings) Merge(cfg *tls.Config) {
+	if 0 == cfg.MinVersion {
+		cfg.MinVersion = s.MinVersion
+	}
+	if 0 == cfg.MaxVersion {
+		cfg.MaxVersion = s.MaxVersion
+	}
+	if nil == cfg.CipherSuites {
+		cfg.CipherSuites = s.CipherSuites
+	}
+	if nil == cfg.CurvePreferences {
+		cfg.CurvePreferences = s.CurvePreferences
+	}
+	if nil == cfg.NextProtos {
+		cfg.NextProtos = s.NextProtos
+	}
+	if tls.NoClientCert == cfg.ClientAuth {
+		cfg.ClientAuth = s.ClientAuth
+	}
+	cfg.SessionTicketsDisabled = cfg.SessionTicketsDisabled || s.SessionTicketsDisabled
+}
+
+// Record cfg's Settings for every child forked from now on.  Listen does
+// this itself; call it again after changing cfg.
+func Pass(cfg *tls.Config) error {
+	b, err := json.Marshal(SettingsOf(cfg))
+	if nil != err {
+		return err
+	}
+	return os.Setenv(settingsEnv, string(b))
+}
+
+// The Settings our parent passed.  The bool is false if it passed none, as on
+// first boot.
+func Passed() (Settings, bool, error) {
+	var s Settings
+	v := os.Getenv(settingsEnv)
+	if "" == v {
+		return s, false, nil
+	}
+	if err := json.Unmarshal([]byte(v), &s); nil != err {
+		return s, false, fmt.Errorf("%s: %w", settingsEnv, err)
+	}
+	return s, true, nil
+}
+
+// A TLS listener over a socket goagain can pass.  Unwrap exposes the socket,
+// so the Listener can go straight to Wait or in a GracefulListener.
+type Listener struct {
+	net.Listener
+	raw net.Listener
+}
+
+// The listening socket underneath the TLS layer.
+func (l *Listener) Unwrap() net.Listener {
+	return l.raw
+}
+
+// Take over the listener our parent passed for network and addr, or listen
+// afresh, and serve TLS on it with cfg.  cfg should hold what the child
+// reloads, its certificates above all; the Settings our parent passed are
+// merged in, and the result recorded for our own children.  The bool
+// reports whether the socket was inherited.
+func Listen(network, addr string, cfg *tls.Config) (*Listener, bool, error) {
+	s, ok, err := Passed()
+	if nil != err {
+		return nil, false, err
+	}
+	if ok {
+		s.Merge(cfg)
+	}
+	if err := Pass(cfg); nil != err {
+		return nil, false, err
+	}
+	raw, inherited, err := goagain.ListenAndInherit(network, addr)
+	if nil != err {
+		return nil, false, err
+	}
+	return &Listener{Listener: tls.NewListener(raw, cfg), raw: raw}, inherited, nil
+}
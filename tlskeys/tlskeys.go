@@ -0,0 +1,86 @@
+// Carry TLS session ticket keys across a goagain restart so clients can
+// resume their sessions with the new generation instead of doing a full
+// handshake.
+//
+// crypto/tls doesn't reveal the keys it generates itself, so this only
+// helps a server that manages its own with tls.Config.SetSessionTicketKeys.
+// The keys go through a pipe the child inherits rather than the
+// environment, which other processes on the host may be able to read.
+package tlskeys
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/blamarvt/goagain"
+)
+
+// The length of a session ticket key.
+const keySize = 32
+
+// Queue keys, newest first as for SetSessionTicketKeys, to be passed to the
+// next child.  Call it shortly before the fork, say from Config.OnPhase when
+// PhaseFork starts, so the child gets the keys in use at the time.  A child
+// reads the pipe dry, and PhaseFork starts afresh for each of ForkRetries,
+// so calling it there also gives every attempt a pipe of its own.  The pipe
+// is only passed for the restart under way; once that's over, the fd is
+// dropped from the environment and a later restart needs another Pass.
+func Pass(keys [][keySize]byte) error {
+	if 0 == len(keys) {
+		return errors.New("no session ticket keys to pass")
+	}
+	r, w, err := os.Pipe()
+	if nil != err {
+		return err
+	}
+	defer r.Close()
+
+	// A pipe holds at least 4KiB, far more than a few keys, so writing
+	// before anyone reads can't block.
+	for _, k := range keys {
+		if _, err := w.Write(k[:]); nil != err {
+			w.Close()
+			return err
+		}
+	}
+	if err := w.Close(); nil != err {
+		return err
+	}
+	return goagain.TransferFileEnv(r, "GOAGAIN_TLS_KEYS_FD")
+}
+
+// Read the keys our parent passed with Pass.  They can only be read once.
+func Keys() ([][keySize]byte, error) {
+	var fd uintptr
+	if _, err := fmt.Sscan(os.Getenv("GOAGAIN_TLS_KEYS_FD"), &fd); nil != err {
+		return nil, fmt.Errorf("no session ticket keys in the environment: %v", err)
+	}
+	os.Unsetenv("GOAGAIN_TLS_KEYS_FD")
+	f := os.NewFile(fd, "goagain-tls-keys")
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if nil != err {
+		return nil, err
+	}
+	if 0 == len(b) || 0 != len(b)%keySize {
+		return nil, fmt.Errorf("%d bytes of session ticket keys is not a whole number of keys", len(b))
+	}
+	keys := make([][keySize]byte, len(b)/keySize)
+	for i := range keys {
+		copy(keys[i][:], b[i*keySize:])
+	}
+	return keys, nil
+}
+
+// Install the keys our parent passed on cfg.
+func Restore(cfg *tls.Config) error {
+	keys, err := Keys()
+	if nil != err {
+		return err
+	}
+	cfg.SetSessionTicketKeys(keys)
+	return nil
+}
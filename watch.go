@@ -0,0 +1,100 @@
+package goagain
+
+import (
+	"context"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// How often WatchBinary stats the binary.  A change must also look the same
+// on the following poll before it triggers a restart.
+var WatchInterval = time.Second
+
+// Restart when the binary is replaced.  This is NewWithConfig(...)
+// .WatchBinary(l).
+func WatchBinary(l net.Listener, quitSignal syscall.Signal, timeout time.Duration) error {
+	return NewWithConfig(Config{
+		QuitSignal: quitSignal,
+		Timeout:    timeout,
+	}).WatchBinary(l)
+}
+
+// Wait like Wait but instead of a fork signal, trigger the restart when the
+// binary we'd exec, ForkOptions.Argv0 or os.Args[0] as found in PATH,
+// changes.  Deploying is then just replacing the file.  It's polled every
+// WatchInterval and only counts as changed once its size, modification time
+// and inode have held still for a whole interval and it's executable, so a
+// copy still being written doesn't get exec'd half done.  The fork signal
+// isn't listened for, so it keeps its default disposition; for SIGHUP
+// that's to kill the process, so signal.Ignore it if it may still be sent.
+func (h *Handler) WatchBinary(l net.Listener) error {
+	if err := Validate(l); nil != err {
+		return err
+	}
+	path, _, err := resolveArgv(h.cfg.ForkOptions)
+	if nil != err {
+		return err
+	}
+	fi, err := os.Stat(path)
+	if nil != err {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	forkCh := make(chan os.Signal, 1)
+	go watchBinary(ctx, path, fi, forkCh)
+	logln("Watching", path, "for a new binary...")
+	return h.waitOn(ctx, handoff{ls: []net.Listener{l}}, forkCh, nil)
+}
+
+// Send on forkCh each time path settles into something other than last.
+func watchBinary(ctx context.Context, path string, last os.FileInfo, forkCh chan<- os.Signal) {
+	var pending os.FileInfo
+	tick := time.NewTicker(WatchInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+		fi, err := os.Stat(path)
+		if nil != err {
+			pending = nil
+			continue
+		}
+		if sameBinary(fi, last) {
+			pending = nil
+			continue
+		}
+		if nil == pending || !sameBinary(fi, pending) {
+			pending = fi
+			continue
+		}
+		if nil != checkExecutable(path) {
+			continue
+		}
+		logln("New binary at", path)
+		last, pending = fi, nil
+		select {
+		case forkCh <- binaryChanged{}:
+		default:
+		}
+	}
+}
+
+// What watchBinary sends on forkCh in place of a fork signal.  The restart
+// it triggers records no Signal.
+type binaryChanged struct{}
+
+func (binaryChanged) String() string { return "binary changed" }
+func (binaryChanged) Signal()        {}
+
+// Test whether two stats of the binary look like the same file contents.
+func sameBinary(a, b os.FileInfo) bool {
+	return os.SameFile(a, b) &&
+		a.Size() == b.Size() &&
+		a.ModTime().Equal(b.ModTime())
+}
@@ -0,0 +1,52 @@
+package goagain
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Replacing the binary restarts, and the restart records no signal.
+func TestWatchBinaryRestarts(t *testing.T) {
+	keepEnv(t)
+	standIn(t, "sleep", syscall.SIGQUIT)
+	interval := WatchInterval
+	defer func() { WatchInterval = interval }()
+	WatchInterval = 10 * time.Millisecond
+
+	bin := filepath.Join(t.TempDir(), "server")
+	if err := os.WriteFile(bin, []byte("old"), 0755); nil != err {
+		t.Fatal(err)
+	}
+	h := NewWithConfig(Config{
+		Timeout:     5 * time.Second,
+		ForkOptions: ForkOptions{Argv0: bin},
+	})
+	errCh := make(chan error, 1)
+	go func() { errCh <- h.WatchBinary(listenTCP(t)) }()
+	time.Sleep(3 * WatchInterval)
+	next := bin + ".new"
+	if err := os.WriteFile(next, []byte("new binary"), 0755); nil != err {
+		t.Fatal(err)
+	}
+	if err := os.Rename(next, bin); nil != err {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-errCh:
+		if nil != err {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no restart after replacing the binary")
+	}
+	res := h.LastResult()
+	defer waitGone(t, res.NewPid)
+	defer syscall.Kill(res.NewPid, syscall.SIGKILL)
+	if nil != res.Signal {
+		t.Errorf("triggered by %v, want no signal", res.Signal)
+	}
+}